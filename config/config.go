@@ -1,15 +1,21 @@
 package config
 
 import (
+	"errors"
+	"io/fs"
 	"log"
 	"os"
+	"strconv"
+	"testing"
 	"time"
 
 	"github.com/joho/godotenv"
 )
 
 var PORT string
+var TRUSTED_PROXIES string
 var SECURITY_CODE string
+var ADMIN_SECURITY_CODE string
 
 var DB_HOST string
 var DB_USER string
@@ -29,6 +35,88 @@ var SFTP_PASSWORD string
 var SFTP_PORT string
 var SFTP_ROOT string
 
+var STORAGE_DRIVER string
+var STORAGE_LOCAL_DIR string
+var STORAGE_CACHE_DIR string
+
+var S3_ENDPOINT string
+var S3_REGION string
+var S3_BUCKET string
+var S3_PREFIX string
+var S3_ACCESS_KEY string
+var S3_SECRET_KEY string
+
+var FACE_MODEL_DIR string
+var RECOGNIZER_POOL_SIZE int
+var RECOGNIZER_ACQUIRE_TIMEOUT time.Duration
+var RECOGNIZER_SIZE int
+var RECOGNIZER_PADDING float32
+var RECOGNIZER_JITTERING int
+var RECOGNIZER_ENROLL_SIZE int
+var RECOGNIZER_ENROLL_PADDING float32
+var RECOGNIZER_ENROLL_JITTERING int
+var RECOGNIZER_VERIFY_SIZE int
+var RECOGNIZER_VERIFY_PADDING float32
+var RECOGNIZER_VERIFY_JITTERING int
+
+var FACE_MAX_TEMPLATES int
+var FACE_TEMPLATE_AGGREGATION string
+
+var FILE_DELETE_MAX_ATTEMPTS int
+var FILE_DELETE_RETRY_INTERVAL time.Duration
+
+var FACE_INDEX_RELOAD_INTERVAL time.Duration
+
+var LOCKOUT_MAX_FAILURES int
+var LOCKOUT_IP_MAX_FAILURES int
+var LOCKOUT_WINDOW time.Duration
+var LOCKOUT_BASE_DURATION time.Duration
+var LOCKOUT_MAX_DURATION time.Duration
+
+var FACE_DISTANCE_METRIC string
+var FACE_METRIC_COMPAT bool
+
+var API_KEY_ROTATION_OVERLAP time.Duration
+var SIGNATURE_MAX_SKEW time.Duration
+var SIGNING_KEY_ENCRYPTION_KEY string
+
+var VERIFICATION_TOKEN_ALG string
+var VERIFICATION_TOKEN_SECRET string
+var VERIFICATION_TOKEN_PRIVATE_KEY_FILE string
+var VERIFICATION_TOKEN_EPHEMERAL_KEY bool
+var VERIFICATION_TOKEN_ISSUER string
+var VERIFICATION_TOKEN_TTL time.Duration
+
+var LIVENESS_ACTIONS string
+var LIVENESS_ACTION_COUNT int
+var LIVENESS_CHALLENGE_TTL time.Duration
+var LIVENESS_MIN_FRAMES int
+var LIVENESS_MAX_FRAMES int
+var LIVENESS_YAW_THRESHOLD float32
+
+var SPOOF_POLICY string
+var SPOOF_THRESHOLD float32
+
+var FACE_SELECTION string
+var FACE_DETECTOR string
+
+var IMAGE_MAX_DIMENSION int
+var IMAGE_MAX_MEGAPIXELS int
+var IMAGE_JPEG_QUALITY int
+
+var QUALITY_CHECK bool
+var QUALITY_MIN_SHARPNESS float32
+var QUALITY_MIN_BRIGHTNESS float32
+var QUALITY_MAX_BRIGHTNESS float32
+var QUALITY_MIN_CONTRAST float32
+var QUALITY_MIN_FACE_SIZE int
+var QUALITY_MAX_YAW float32
+var QUALITY_MAX_ROLL float32
+
+var FACE_THRESHOLD float32
+var FACE_THRESHOLD_MIN float32
+var FACE_THRESHOLD_MAX float32
+
 var JakartaLocation *time.Location
 
 func GetEnv(key, fallback string) string {
@@ -38,14 +126,57 @@ func GetEnv(key, fallback string) string {
 	return fallback
 }
 
+func GetEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return i
+}
+
+func GetEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func GetEnvFloat(key string, fallback float32) float32 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		log.Printf("Invalid float for %s: %q, using %g", key, value, fallback)
+		return fallback
+	}
+	return float32(f)
+}
+
 func init() {
 	err := godotenv.Load(".env")
-	if err != nil {
+	// go test runs in the package directories, which have no .env, the
+	// tests set the settings they need themselves
+	if err != nil && !(testing.Testing() && errors.Is(err, fs.ErrNotExist)) {
 		log.Fatalf("Error loading .env file")
 	}
 
 	PORT = GetEnv("SERVER_PORT", "9000")
+	TRUSTED_PROXIES = GetEnv("TRUSTED_PROXIES", "")
 	SECURITY_CODE = GetEnv("SECURITY_CODE", "")
+	ADMIN_SECURITY_CODE = GetEnv("ADMIN_SECURITY_CODE", "")
 
 	DB_HOST = GetEnv("DB_HOST", "localhost")
 	DB_USER = GetEnv("DB_USER", "postgres")
@@ -64,6 +195,90 @@ func init() {
 	SFTP_PASSWORD = GetEnv("SFTP_PASSWORD", "admin")
 	SFTP_PORT = GetEnv("SFTP_PORT", "221")
 	SFTP_ROOT = GetEnv("SFTP_ROOT", "/upload/sfa_mobile/")
+
+	STORAGE_DRIVER = GetEnv("STORAGE_DRIVER", "sftp")
+	STORAGE_LOCAL_DIR = GetEnv("STORAGE_LOCAL_DIR", "faces/images")
+	STORAGE_CACHE_DIR = GetEnv("STORAGE_CACHE_DIR", "")
+
+	S3_ENDPOINT = GetEnv("S3_ENDPOINT", "")
+	S3_REGION = GetEnv("S3_REGION", "us-east-1")
+	S3_BUCKET = GetEnv("S3_BUCKET", "")
+	S3_PREFIX = GetEnv("S3_PREFIX", "face_key/")
+	S3_ACCESS_KEY = GetEnv("S3_ACCESS_KEY", "")
+	S3_SECRET_KEY = GetEnv("S3_SECRET_KEY", "")
+
+	FACE_MODEL_DIR = GetEnv("FACE_MODEL_DIR", "faces")
+	RECOGNIZER_POOL_SIZE = GetEnvInt("RECOGNIZER_POOL_SIZE", 2)
+	RECOGNIZER_ACQUIRE_TIMEOUT = time.Duration(GetEnvInt("RECOGNIZER_ACQUIRE_TIMEOUT_SECONDS", 30)) * time.Second
+	// go-face defaults, each operation falls back to them
+	RECOGNIZER_SIZE = GetEnvInt("RECOGNIZER_SIZE", 150)
+	RECOGNIZER_PADDING = GetEnvFloat("RECOGNIZER_PADDING", 0.25)
+	RECOGNIZER_JITTERING = GetEnvInt("RECOGNIZER_JITTERING", 0)
+	RECOGNIZER_ENROLL_SIZE = GetEnvInt("RECOGNIZER_ENROLL_SIZE", RECOGNIZER_SIZE)
+	RECOGNIZER_ENROLL_PADDING = GetEnvFloat("RECOGNIZER_ENROLL_PADDING", RECOGNIZER_PADDING)
+	RECOGNIZER_ENROLL_JITTERING = GetEnvInt("RECOGNIZER_ENROLL_JITTERING", RECOGNIZER_JITTERING)
+	RECOGNIZER_VERIFY_SIZE = GetEnvInt("RECOGNIZER_VERIFY_SIZE", RECOGNIZER_SIZE)
+	RECOGNIZER_VERIFY_PADDING = GetEnvFloat("RECOGNIZER_VERIFY_PADDING", RECOGNIZER_PADDING)
+	RECOGNIZER_VERIFY_JITTERING = GetEnvInt("RECOGNIZER_VERIFY_JITTERING", RECOGNIZER_JITTERING)
+
+	FACE_MAX_TEMPLATES = GetEnvInt("FACE_MAX_TEMPLATES", 5)
+	FACE_TEMPLATE_AGGREGATION = GetEnv("FACE_TEMPLATE_AGGREGATION", "min")
+
+	FILE_DELETE_MAX_ATTEMPTS = GetEnvInt("FILE_DELETE_MAX_ATTEMPTS", 10)
+	FILE_DELETE_RETRY_INTERVAL = time.Duration(GetEnvInt("FILE_DELETE_RETRY_INTERVAL_SECONDS", 60)) * time.Second
+
+	FACE_INDEX_RELOAD_INTERVAL = time.Duration(GetEnvInt("FACE_INDEX_RELOAD_INTERVAL_SECONDS", 60)) * time.Second
+
+	LOCKOUT_MAX_FAILURES = GetEnvInt("LOCKOUT_MAX_FAILURES", 5)
+	LOCKOUT_IP_MAX_FAILURES = GetEnvInt("LOCKOUT_IP_MAX_FAILURES", 0)
+	LOCKOUT_WINDOW = time.Duration(GetEnvInt("LOCKOUT_WINDOW_SECONDS", 900)) * time.Second
+	LOCKOUT_BASE_DURATION = time.Duration(GetEnvInt("LOCKOUT_BASE_DURATION_SECONDS", 300)) * time.Second
+	LOCKOUT_MAX_DURATION = time.Duration(GetEnvInt("LOCKOUT_MAX_DURATION_SECONDS", 86400)) * time.Second
+
+	FACE_DISTANCE_METRIC = GetEnv("FACE_DISTANCE_METRIC", "euclidean")
+	FACE_METRIC_COMPAT = GetEnvBool("FACE_METRIC_COMPAT", false)
+
+	API_KEY_ROTATION_OVERLAP = time.Duration(GetEnvInt("API_KEY_ROTATION_OVERLAP_SECONDS", 86400)) * time.Second
+	SIGNATURE_MAX_SKEW = time.Duration(GetEnvInt("SIGNATURE_MAX_SKEW_SECONDS", 300)) * time.Second
+	SIGNING_KEY_ENCRYPTION_KEY = GetEnv("SIGNING_KEY_ENCRYPTION_KEY", "")
+
+	VERIFICATION_TOKEN_ALG = GetEnv("VERIFICATION_TOKEN_ALG", "EdDSA")
+	VERIFICATION_TOKEN_SECRET = GetEnv("VERIFICATION_TOKEN_SECRET", "")
+	VERIFICATION_TOKEN_PRIVATE_KEY_FILE = GetEnv("VERIFICATION_TOKEN_PRIVATE_KEY_FILE", "")
+	VERIFICATION_TOKEN_EPHEMERAL_KEY = GetEnvBool("VERIFICATION_TOKEN_EPHEMERAL_KEY", false)
+	VERIFICATION_TOKEN_ISSUER = GetEnv("VERIFICATION_TOKEN_ISSUER", "arkan-face-key")
+	VERIFICATION_TOKEN_TTL = time.Duration(GetEnvInt("VERIFICATION_TOKEN_TTL_SECONDS", 120)) * time.Second
+
+	LIVENESS_ACTIONS = GetEnv("LIVENESS_ACTIONS", "turn_left,turn_right")
+	LIVENESS_ACTION_COUNT = GetEnvInt("LIVENESS_ACTION_COUNT", 2)
+	LIVENESS_CHALLENGE_TTL = time.Duration(GetEnvInt("LIVENESS_CHALLENGE_TTL_SECONDS", 60)) * time.Second
+	LIVENESS_MIN_FRAMES = GetEnvInt("LIVENESS_MIN_FRAMES", 3)
+	LIVENESS_MAX_FRAMES = GetEnvInt("LIVENESS_MAX_FRAMES", 15)
+	LIVENESS_YAW_THRESHOLD = GetEnvFloat("LIVENESS_YAW_THRESHOLD", 0.3)
+
+	SPOOF_POLICY = GetEnv("SPOOF_POLICY", "log")
+	SPOOF_THRESHOLD = GetEnvFloat("SPOOF_THRESHOLD", 0.5)
+
+	FACE_SELECTION = GetEnv("FACE_SELECTION", "reject")
+	FACE_DETECTOR = GetEnv("FACE_DETECTOR", "hog")
+
+	IMAGE_MAX_DIMENSION = GetEnvInt("IMAGE_MAX_DIMENSION", 1600)
+	IMAGE_MAX_MEGAPIXELS = GetEnvInt("IMAGE_MAX_MEGAPIXELS", 50)
+	IMAGE_JPEG_QUALITY = GetEnvInt("IMAGE_JPEG_QUALITY", 92)
+
+	QUALITY_CHECK = GetEnvBool("QUALITY_CHECK", true)
+	QUALITY_MIN_SHARPNESS = GetEnvFloat("QUALITY_MIN_SHARPNESS", 50)
+	QUALITY_MIN_BRIGHTNESS = GetEnvFloat("QUALITY_MIN_BRIGHTNESS", 60)
+	QUALITY_MAX_BRIGHTNESS = GetEnvFloat("QUALITY_MAX_BRIGHTNESS", 200)
+	QUALITY_MIN_CONTRAST = GetEnvFloat("QUALITY_MIN_CONTRAST", 25)
+	QUALITY_MIN_FACE_SIZE = GetEnvInt("QUALITY_MIN_FACE_SIZE", 100)
+	QUALITY_MAX_YAW = GetEnvFloat("QUALITY_MAX_YAW", 0.2)
+	QUALITY_MAX_ROLL = GetEnvFloat("QUALITY_MAX_ROLL", 15)
+
+	// Thresholds are Euclidean distances, converted for the other metrics
+	FACE_THRESHOLD = GetEnvFloat("FACE_THRESHOLD", 0.6)
+	FACE_THRESHOLD_MIN = GetEnvFloat("FACE_THRESHOLD_MIN", 0.3)
+	FACE_THRESHOLD_MAX = GetEnvFloat("FACE_THRESHOLD_MAX", 0.6)
 }
 
 func InitTimeZone() error {
@@ -1 +1,37 @@
 package dto
+
+import "time"
+
+// FaceMatchOptions holds the optional matching fields of a request.
+type FaceMatchOptions struct {
+	// Threshold is the maximum distance accepted as a match, zero means
+	// the server policy. Only honored when Privileged.
+	Threshold float32
+	// Metric names the distance metric, empty means the configured one.
+	Metric string
+	// Privileged is set when the API client has the admin scope.
+	Privileged bool
+	// Selection picks the face of an image with several faces.
+	Selection FaceSelection
+}
+
+// FaceSelection holds the optional face selection fields of a request.
+type FaceSelection struct {
+	// Mode is reject, largest, most_central or index, empty means the
+	// configured one.
+	Mode string
+	// Index is the face to use in index mode, counting left to right.
+	Index int
+}
+
+// FaceAuditQuery filters the face audit log, zero values match everything.
+type FaceAuditQuery struct {
+	Username string
+	Action   string
+	Outcome  string
+	Client   string
+	From     time.Time
+	To       time.Time
+	Page     int
+	Limit    int
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"arkan-face-key/helper"
+	"arkan-face-key/service"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ApiClientHandler struct {
+	apiClients service.ApiClientService
+}
+
+func NewApiClientHandler(apiClients service.ApiClientService) *ApiClientHandler {
+	return &ApiClientHandler{apiClients}
+}
+
+func (h *ApiClientHandler) ListClients(c *gin.Context) {
+	res, errRes := h.apiClients.ListClients(c)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *ApiClientHandler) CreateClient(c *gin.Context) {
+	// scopes is a comma separated list, e.g. "enroll,verify"
+	var scopes []string
+	for _, scope := range strings.Split(c.PostForm("scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	requireSignature, _ := strconv.ParseBool(c.PostForm("require_signature"))
+
+	res, errRes := h.apiClients.CreateClient(c, c.PostForm("name"), c.PostForm("description"), scopes, requireSignature)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *ApiClientHandler) RotateKey(c *gin.Context) {
+	res, errRes := h.apiClients.RotateKey(c, c.Param("name"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *ApiClientHandler) RevokeKey(c *gin.Context) {
+	res, errRes := h.apiClients.RevokeKey(c, c.Param("name"), c.Param("key_id"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+	})
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"arkan-face-key/helper"
+	"arkan-face-key/service"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FaceAuditHandler struct {
+	auditLog service.AuditLog
+}
+
+func NewFaceAuditHandler(auditLog service.AuditLog) *FaceAuditHandler {
+	return &FaceAuditHandler{auditLog}
+}
+
+func (h *FaceAuditHandler) GetAuditLog(c *gin.Context) {
+	query := dto.FaceAuditQuery{
+		Username: c.Query("username"),
+		Action:   c.Query("action"),
+		Outcome:  c.Query("outcome"),
+		Client:   c.Query("client"),
+		Page:     1,
+		Limit:    20,
+	}
+
+	var err error
+	if pageStr := c.Query("page"); pageStr != "" {
+		query.Page, err = strconv.Atoi(pageStr)
+		if err != nil || query.Page < 1 {
+			c.JSON(http.StatusBadRequest, helper.Response{
+				Status:  400,
+				Message: "page must be a positive integer",
+			})
+			return
+		}
+	}
+	if limitStr := c.Query("limit"); limitStr != "" {
+		query.Limit, err = strconv.Atoi(limitStr)
+		if err != nil || query.Limit < 1 || query.Limit > 100 {
+			c.JSON(http.StatusBadRequest, helper.Response{
+				Status:  400,
+				Message: "limit must be an integer between 1 and 100",
+			})
+			return
+		}
+	}
+
+	// from/to accept RFC3339 timestamps or plain dates in Jakarta time
+	if fromStr := c.Query("from"); fromStr != "" {
+		query.From, err = parseAuditTime(fromStr, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, helper.Response{
+				Status:  400,
+				Message: "from must be an RFC3339 timestamp or a YYYY-MM-DD date",
+			})
+			return
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		query.To, err = parseAuditTime(toStr, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, helper.Response{
+				Status:  400,
+				Message: "to must be an RFC3339 timestamp or a YYYY-MM-DD date",
+			})
+			return
+		}
+	}
+
+	res, errRes := h.auditLog.Query(c, query)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Meta:    res.Meta,
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+// parseAuditTime parses an RFC3339 timestamp or a date, which covers the
+// whole day when used as the end of a range.
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, config.JakartaLocation)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
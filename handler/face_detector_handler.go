@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"arkan-face-key/helper"
+	"arkan-face-key/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FaceDetectorHandler struct {
+	faceDetector service.FaceDetector
+}
+
+func NewFaceDetectorHandler(faceDetector service.FaceDetector) *FaceDetectorHandler {
+	return &FaceDetectorHandler{faceDetector}
+}
+
+func (h *FaceDetectorHandler) GetMetrics(c *gin.Context) {
+	res, errRes := h.faceDetector.Metrics(c)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"arkan-face-key/dto"
 	"arkan-face-key/helper"
+	"arkan-face-key/middleware"
 	"arkan-face-key/service"
 	"net/http"
 	"strconv"
@@ -17,6 +19,61 @@ func NewFaceRecognitionHandler(service service.FaceRecognitionService) *FaceReco
 	return &FaceRecognitionHandler{service}
 }
 
+// bindFaceSelection reads the optional face_selection and face_index form
+// fields, writing a 400 response when the index is malformed.
+func bindFaceSelection(c *gin.Context) (dto.FaceSelection, bool) {
+	selection := dto.FaceSelection{
+		Mode: c.PostForm("face_selection"),
+	}
+
+	indexStr := c.PostForm("face_index")
+	if indexStr != "" {
+		index, err := strconv.Atoi(indexStr)
+		if err != nil || index < 0 {
+			c.JSON(http.StatusBadRequest, helper.Response{
+				Status:  400,
+				Message: "face_index must be a non-negative integer",
+			})
+			return selection, false
+		}
+		selection.Index = index
+		if selection.Mode == "" {
+			selection.Mode = service.FaceSelectionIndex
+		}
+	}
+	return selection, true
+}
+
+// bindFaceMatchOptions reads the optional threshold, metric and face
+// selection form fields, writing a 400 response when they are malformed.
+// The threshold is only honored for privileged callers.
+func bindFaceMatchOptions(c *gin.Context) (dto.FaceMatchOptions, bool) {
+	options := dto.FaceMatchOptions{
+		Metric:     c.PostForm("metric"),
+		Privileged: middleware.IsPrivileged(c),
+	}
+
+	thresholdStr := c.PostForm("threshold")
+	if thresholdStr != "" {
+		threshold64, err := strconv.ParseFloat(thresholdStr, 32)
+		if err != nil || threshold64 < 0 {
+			c.JSON(http.StatusBadRequest, helper.Response{
+				Status:  400,
+				Message: "Threshold must be a valid float",
+			})
+			return options, false
+		}
+		options.Threshold = float32(threshold64)
+	}
+
+	selection, ok := bindFaceSelection(c)
+	if !ok {
+		return options, false
+	}
+	options.Selection = selection
+	return options, true
+}
+
 func (h *FaceRecognitionHandler) SaveUserFaceKey(c *gin.Context) {
 	image, err := c.FormFile("image")
 	if err != nil {
@@ -37,11 +94,20 @@ func (h *FaceRecognitionHandler) SaveUserFaceKey(c *gin.Context) {
 		return
 	}
 
-	res, errRes := h.service.SaveUserFaceKey(c, image, username)
+	selection, ok := bindFaceSelection(c)
+	if !ok {
+		return
+	}
+
+	// Mobile retries send the same Idempotency-Key to avoid duplicate uploads
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+
+	res, errRes := h.service.SaveUserFaceKey(c, image, username, selection, idempotencyKey)
 	if errRes != nil {
 		c.JSON(errRes.Status, helper.Response{
 			Status:  errRes.Status,
 			Message: errRes.Message,
+			Data:    errRes.Data,
 		})
 		return
 	}
@@ -73,29 +139,17 @@ func (h *FaceRecognitionHandler) ValidateWithEmbedding(c *gin.Context) {
 		return
 	}
 
-	thresholdStr := c.PostForm("threshold")
-	var threshold float32
-	if thresholdStr != "" {
-		var threshold64 float64
-		threshold64, err = strconv.ParseFloat(thresholdStr, 32)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, helper.Response{
-				Status:  400,
-				Message: "Threshold must be a valid float",
-			})
-			return
-		}
-		threshold = float32(threshold64)
-	} else {
-		// Default threshold if not provided
-		threshold = 0.6
+	options, ok := bindFaceMatchOptions(c)
+	if !ok {
+		return
 	}
 
-	res, errRes := h.service.ValidateWithEmbedding(c, image, username, threshold)
+	res, errRes := h.service.ValidateWithEmbedding(c, image, username, options)
 	if errRes != nil {
 		c.JSON(errRes.Status, helper.Response{
 			Status:  errRes.Status,
 			Message: errRes.Message,
+			Data:    errRes.Data,
 		})
 		return
 	}
@@ -127,29 +181,139 @@ func (h *FaceRecognitionHandler) ValidateWithImage(c *gin.Context) {
 		return
 	}
 
-	thresholdStr := c.PostForm("threshold")
-	var threshold float32
-	if thresholdStr != "" {
-		var threshold64 float64
-		threshold64, err = strconv.ParseFloat(thresholdStr, 32)
-		if err != nil {
+	options, ok := bindFaceMatchOptions(c)
+	if !ok {
+		return
+	}
+
+	res, errRes := h.service.ValidateWithImage(c, image, username, options)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+			Data:    errRes.Data,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) IssueLivenessChallenge(c *gin.Context) {
+	username := c.PostForm("username")
+	if username == "" {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Username is required",
+		})
+		return
+	}
+
+	res, errRes := h.service.IssueLivenessChallenge(c, username)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) ValidateWithLiveness(c *gin.Context) {
+	// frames are the images of the recording, in order
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["frames"]) == 0 {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Frames are required",
+		})
+		return
+	}
+
+	username := c.PostForm("username")
+	if username == "" {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Username is required",
+		})
+		return
+	}
+
+	challengeId := c.PostForm("challenge_id")
+	if challengeId == "" {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Challenge ID is required",
+		})
+		return
+	}
+
+	options, ok := bindFaceMatchOptions(c)
+	if !ok {
+		return
+	}
+
+	res, errRes := h.service.ValidateWithLiveness(c, form.File["frames"], username, challengeId, options)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+			Data:    errRes.Data,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) Identify(c *gin.Context) {
+	image, err := c.FormFile("image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Image file is required",
+		})
+		return
+	}
+
+	topK := 5
+	if topKStr := c.PostForm("top_k"); topKStr != "" {
+		topK, err = strconv.Atoi(topKStr)
+		if err != nil || topK < 1 || topK > 50 {
 			c.JSON(http.StatusBadRequest, helper.Response{
 				Status:  400,
-				Message: "Threshold must be a valid float",
+				Message: "top_k must be an integer between 1 and 50",
 			})
 			return
 		}
-		threshold = float32(threshold64)
-	} else {
-		// Default threshold if not provided
-		threshold = 0.6
 	}
 
-	res, errRes := h.service.ValidateWithImage(c, image, username, threshold)
+	// Threshold is optional, the default threshold policy applies otherwise
+	options, ok := bindFaceMatchOptions(c)
+	if !ok {
+		return
+	}
+
+	res, errRes := h.service.Identify(c, image, topK, options)
 	if errRes != nil {
 		c.JSON(errRes.Status, helper.Response{
 			Status:  errRes.Status,
 			Message: errRes.Message,
+			Data:    errRes.Data,
 		})
 		return
 	}
@@ -157,5 +321,203 @@ func (h *FaceRecognitionHandler) ValidateWithImage(c *gin.Context) {
 	c.JSON(http.StatusOK, helper.Response{
 		Status:  res.Status,
 		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) DetectFaces(c *gin.Context) {
+	image, err := c.FormFile("image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Image file is required",
+		})
+		return
+	}
+
+	res, errRes := h.service.DetectFaces(c, image)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) CompareFaces(c *gin.Context) {
+	imageA, err := c.FormFile("image_a")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Image file image_a is required",
+		})
+		return
+	}
+	imageB, err := c.FormFile("image_b")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Image file image_b is required",
+		})
+		return
+	}
+
+	// Threshold is optional, the default threshold policy applies otherwise
+	options, ok := bindFaceMatchOptions(c)
+	if !ok {
+		return
+	}
+
+	res, errRes := h.service.CompareFaces(c, imageA, imageB, options)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+			Data:    errRes.Data,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) AddFaceTemplate(c *gin.Context) {
+	image, err := c.FormFile("image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Image file is required",
+		})
+		return
+	}
+
+	username := c.PostForm("username")
+	if username == "" {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Username is required",
+		})
+		return
+	}
+
+	// Source describes where the template came from, e.g. "enrollment" or "verification"
+	source := c.DefaultPostForm("source", "enrollment")
+
+	selection, ok := bindFaceSelection(c)
+	if !ok {
+		return
+	}
+
+	res, errRes := h.service.AddFaceTemplate(c, image, username, source, selection)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+			Data:    errRes.Data,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) ListFaceTemplates(c *gin.Context) {
+	res, errRes := h.service.ListFaceTemplates(c, c.Param("username"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) RemoveFaceTemplate(c *gin.Context) {
+	res, errRes := h.service.RemoveFaceTemplate(c, c.Param("username"), c.Param("template_id"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) GetFaceKeyStatus(c *gin.Context) {
+	res, errRes := h.service.GetFaceKeyStatus(c, c.Param("username"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) DeleteFaceKey(c *gin.Context) {
+	res, errRes := h.service.DeleteFaceKey(c, c.Param("username"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceRecognitionHandler) ClearLockout(c *gin.Context) {
+	// device and ip optionally clear the lockout of the caller's device too
+	res, errRes := h.service.ClearLockout(c, c.Param("username"), c.Query("device"), c.Query("ip"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
 	})
 }
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"arkan-face-key/helper"
+	"arkan-face-key/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FaceThresholdPolicyHandler struct {
+	thresholdPolicy service.ThresholdPolicy
+}
+
+func NewFaceThresholdPolicyHandler(thresholdPolicy service.ThresholdPolicy) *FaceThresholdPolicyHandler {
+	return &FaceThresholdPolicyHandler{thresholdPolicy}
+}
+
+func (h *FaceThresholdPolicyHandler) ListThresholdPolicies(c *gin.Context) {
+	res, errRes := h.thresholdPolicy.List(c)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceThresholdPolicyHandler) SetThresholdPolicy(c *gin.Context) {
+	// threshold is a Euclidean distance, whatever metric the requests use
+	threshold, err := strconv.ParseFloat(c.PostForm("threshold"), 32)
+	if err != nil || threshold <= 0 {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Threshold must be a positive float",
+		})
+		return
+	}
+
+	res, errRes := h.thresholdPolicy.Set(c, c.Param("scope"), c.Param("subject"), float32(threshold))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+func (h *FaceThresholdPolicyHandler) DeleteThresholdPolicy(c *gin.Context) {
+	res, errRes := h.thresholdPolicy.Delete(c, c.Param("scope"), c.Param("subject"))
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+	})
+}
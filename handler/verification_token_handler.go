@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"arkan-face-key/helper"
+	"arkan-face-key/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type VerificationTokenHandler struct {
+	verificationTokens service.VerificationTokenService
+}
+
+func NewVerificationTokenHandler(verificationTokens service.VerificationTokenService) *VerificationTokenHandler {
+	return &VerificationTokenHandler{verificationTokens}
+}
+
+func (h *VerificationTokenHandler) VerifyToken(c *gin.Context) {
+	token := c.PostForm("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, helper.Response{
+			Status:  400,
+			Message: "Token is required",
+		})
+		return
+	}
+
+	res, errRes := h.verificationTokens.Introspect(c, token)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, helper.Response{
+		Status:  res.Status,
+		Message: res.Message,
+		Data:    res.Data,
+	})
+}
+
+// GetJWKS answers with a bare JSON Web Key Set, the format JWT libraries
+// expect, instead of the usual response envelope.
+func (h *VerificationTokenHandler) GetJWKS(c *gin.Context) {
+	res, errRes := h.verificationTokens.JWKS(c)
+	if errRes != nil {
+		c.JSON(errRes.Status, helper.Response{
+			Status:  errRes.Status,
+			Message: errRes.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, res.Data)
+}
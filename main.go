@@ -4,7 +4,16 @@ import (
 	"arkan-face-key/config"
 	"arkan-face-key/middleware"
 	"arkan-face-key/router"
+	"arkan-face-key/service"
+	"arkan-face-key/storage"
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,27 +24,80 @@ func main() {
 		log.Fatalf("Failed to load timezone: %v", err)
 	}
 
+	recognizerPools, err := service.NewRecognizerPools(config.FACE_MODEL_DIR, config.RECOGNIZER_POOL_SIZE)
+	if err != nil {
+		log.Fatalf("Failed to load face recognition models: %v", err)
+	}
+
 	mdb, err := config.OpenMongoConnection()
 	if err != nil {
 		log.Fatal("Error connecting to MongoDB")
 	}
 
-	sftp, err := config.OpenSFTPConnection()
+	store, err := storage.Open()
 	if err != nil {
-		log.Fatal("Error connecting to SFTP server")
+		log.Fatalf("Error opening %s file storage: %v", config.STORAGE_DRIVER, err)
+	}
+
+	// ctx is cancelled on SIGINT/SIGTERM and stops the background workers
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	apiClientService, err := service.NewApiClientService(mdb)
+	if err != nil {
+		log.Fatalf("Invalid request signing configuration: %v", err)
+	}
+	nonceStore := service.NewNonceStore(mdb)
+	if err := nonceStore.EnsureIndexes(ctx); err != nil {
+		log.Printf("Failed to create request nonce indexes: %v", err)
 	}
 
 	r := gin.Default()
 
+	// Only proxies listed in TRUSTED_PROXIES may set the client IP through
+	// X-Forwarded-For, otherwise any client could choose its own
+	var trustedProxies []string
+	for _, proxy := range strings.Split(config.TRUSTED_PROXIES, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	r.Use(middleware.RequestIdMiddleware())
 	r.Use(middleware.CORSMiddleware())
-	r.Use(middleware.AuthMiddleware())
+	r.Use(middleware.AuthMiddleware(apiClientService, nonceStore))
 
-	router.SetupFaceRecognitionRouter(r, mdb, sftp)
+	router.SetupFaceRecognitionRouter(ctx, r, mdb, store, recognizerPools, apiClientService)
 
 	port := config.PORT
 	if port == "" {
 		port = "9050"
 	}
-	log.Println("Starting server on port " + port)
-	r.Run(":" + port)
+
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+	}
+
+	go func() {
+		log.Println("Starting server on port " + port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+
+	recognizerPools.Close()
+	log.Println("Server exited")
 }
@@ -2,13 +2,39 @@ package middleware
 
 import (
 	"arkan-face-key/config"
+	"arkan-face-key/model"
+	"arkan-face-key/service"
+	"arkan-face-key/signing"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// maxSignedBodySize bounds the body read to verify a signature.
+const maxSignedBodySize = 32 << 20
+
+// Gin context keys of the authenticated API client.
+const (
+	ClientKey     = "client"
+	ClientNameKey = "client_name"
+)
+
+// AuthMiddleware authenticates the API key sent in the Security-Code header,
+// or the signature of a signed request, and attaches its client to the
+// context.
+func AuthMiddleware(apiClients service.ApiClientService, nonces service.NonceStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		securityCode := config.SECURITY_CODE
+		if c.GetHeader(signing.SignatureHeader) != "" {
+			authenticateSignedRequest(c, apiClients, nonces)
+			return
+		}
+
 		authHeader := c.GetHeader("Security-Code")
 
 		if authHeader == "" {
@@ -20,7 +46,18 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if authHeader != securityCode {
+		client, err := apiClients.Authenticate(c, authHeader)
+		if err != nil {
+			log.Printf("Error authenticating API key: %v", err)
+			c.JSON(500, gin.H{
+				"status": 500,
+				"error":  "Error authenticating Security-Code",
+			})
+			c.Abort()
+			return
+		}
+
+		if client == nil {
 			c.JSON(401, gin.H{
 				"status": 401,
 				"error":  "Invalid Security-Code",
@@ -29,7 +66,142 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if client.RequireSignature {
+			c.JSON(401, gin.H{
+				"status": 401,
+				"error":  "Requests of this API client must be signed",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set(ClientKey, *client)
+		c.Set(ClientNameKey, client.Name)
+
 		// Continue to the next middleware/handler
 		c.Next()
 	}
 }
+
+// authenticateSignedRequest checks the signature headers of package
+// signing. A request is only accepted once, within SIGNATURE_MAX_SKEW of its
+// timestamp.
+func authenticateSignedRequest(c *gin.Context, apiClients service.ApiClientService, nonces service.NonceStore) {
+	reject := func(status int, message string) {
+		c.JSON(status, gin.H{
+			"status": status,
+			"error":  message,
+		})
+		c.Abort()
+	}
+
+	keyId := c.GetHeader(signing.KeyIdHeader)
+	timestamp := c.GetHeader(signing.TimestampHeader)
+	nonce := c.GetHeader(signing.NonceHeader)
+	if keyId == "" || timestamp == "" || len(nonce) < 16 || len(nonce) > 128 {
+		reject(401, "Signed requests need X-Key-Id, X-Timestamp and an X-Nonce of 16 to 128 characters")
+		return
+	}
+
+	// Reject stale or future timestamps
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		reject(401, "X-Timestamp must be a unix timestamp in seconds")
+		return
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > config.SIGNATURE_MAX_SKEW || skew < -config.SIGNATURE_MAX_SKEW {
+		reject(401, "Request timestamp is too far from the server time")
+		return
+	}
+
+	client, apiKey, err := apiClients.FindKey(c, keyId)
+	if err != nil {
+		log.Printf("Error loading API key %s: %v", keyId, err)
+		reject(500, "Error authenticating request signature")
+		return
+	}
+	if client == nil {
+		reject(401, "Invalid request signature")
+		return
+	}
+
+	// The body is hashed as sent and put back for the handlers
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBodySize))
+	if err != nil {
+		reject(413, "Request body is too large")
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	signingKey, err := apiClients.SigningKey(apiKey)
+	if errors.Is(err, service.ErrSigningDisabled) || errors.Is(err, service.ErrNoSigningKey) {
+		reject(401, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading signing key of API key %s: %v", keyId, err)
+		reject(500, "Error authenticating request signature")
+		return
+	}
+
+	message := signing.CanonicalString(c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, signing.BodyHash(body))
+	if !signing.Verify(signingKey, message, c.GetHeader(signing.SignatureHeader)) {
+		reject(401, "Invalid request signature")
+		return
+	}
+
+	// Only check the nonce of valid signatures, so nobody can burn them
+	fresh, err := nonces.Use(c, keyId+":"+nonce)
+	if err != nil {
+		log.Printf("Error recording nonce of API key %s: %v", keyId, err)
+		reject(500, "Error authenticating request signature")
+		return
+	}
+	if !fresh {
+		reject(401, "Request was already used")
+		return
+	}
+
+	c.Set(ClientKey, *client)
+	c.Set(ClientNameKey, client.Name)
+
+	// Continue to the next middleware/handler
+	c.Next()
+}
+
+// GetClient returns the API client of the request.
+func GetClient(c *gin.Context) (model.ApiClient, bool) {
+	client, ok := c.Get(ClientKey)
+	if !ok {
+		return model.ApiClient{}, false
+	}
+	return client.(model.ApiClient), true
+}
+
+// HasScope reports whether the API client of the request may use scope.
+func HasScope(c *gin.Context, scope string) bool {
+	client, ok := GetClient(c)
+	return ok && client.HasScope(scope)
+}
+
+// IsPrivileged reports whether the caller may use privileged options, like
+// a custom threshold.
+func IsPrivileged(c *gin.Context) bool {
+	return HasScope(c, model.ScopeAdmin)
+}
+
+// RequireScope rejects API clients without scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasScope(c, scope) {
+			c.JSON(403, gin.H{
+				"status": 403,
+				"error":  "API client is missing the " + scope + " scope",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
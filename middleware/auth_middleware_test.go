@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"arkan-face-key/model"
+	"arkan-face-key/service"
+	"arkan-face-key/signing"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testKeyId  = "a1b2c3d4"
+	testSecret = "dGhpcyBpcyBhIHJhbmRvbSBzZWNyZXQ"
+)
+
+// fakeApiClients knows the clients by key id. Methods the middleware
+// doesn't call panic through the nil embedded interface.
+type fakeApiClients struct {
+	service.ApiClientService
+	clients     map[string]model.ApiClient
+	signingKeys map[string]string
+}
+
+func (f *fakeApiClients) Authenticate(ctx context.Context, key string) (*model.ApiClient, error) {
+	keyId, secret, _ := strings.Cut(key, ".")
+	client, ok := f.clients[keyId]
+	if !ok || secret != testSecret {
+		return nil, nil
+	}
+	return &client, nil
+}
+
+func (f *fakeApiClients) FindKey(ctx context.Context, keyId string) (*model.ApiClient, *model.ApiKey, error) {
+	client, ok := f.clients[keyId]
+	if !ok {
+		return nil, nil, nil
+	}
+	return &client, &model.ApiKey{Id: keyId, SigningKey: f.signingKeys[keyId]}, nil
+}
+
+func (f *fakeApiClients) SigningKey(apiKey *model.ApiKey) (string, error) {
+	if apiKey.SigningKey == "" {
+		return "", service.ErrNoSigningKey
+	}
+	return apiKey.SigningKey, nil
+}
+
+type fakeNonces map[string]bool
+
+func (f fakeNonces) EnsureIndexes(ctx context.Context) error { return nil }
+
+func (f fakeNonces) Use(ctx context.Context, nonce string) (bool, error) {
+	if f[nonce] {
+		return false, nil
+	}
+	f[nonce] = true
+	return true, nil
+}
+
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	apiClients := &fakeApiClients{
+		clients: map[string]model.ApiClient{
+			testKeyId:  {Name: "mobile", Scopes: []string{model.ScopeVerify}},
+			"signonly": {Name: "batch", Scopes: []string{model.ScopeVerify}, RequireSignature: true},
+			"oldkey":   {Name: "legacy-signer", Scopes: []string{model.ScopeVerify}},
+		},
+		signingKeys: map[string]string{
+			testKeyId:  signing.DeriveKey(testSecret),
+			"signonly": signing.DeriveKey(testSecret),
+		},
+	}
+
+	r := gin.New()
+	r.Use(AuthMiddleware(apiClients, fakeNonces{}))
+	r.POST("/api/face/validate/image", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(ClientNameKey))
+	})
+	return r
+}
+
+type signedRequest struct {
+	keyId     string
+	timestamp time.Time
+	nonce     string
+	signed    string // body covered by the signature
+	sent      string // body actually sent
+}
+
+func (s signedRequest) build() *http.Request {
+	target := "/api/face/validate/image?metric=cosine"
+	timestamp := strconv.FormatInt(s.timestamp.Unix(), 10)
+	message := signing.CanonicalString(http.MethodPost, target, timestamp, s.nonce, signing.BodyHash([]byte(s.signed)))
+
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(s.sent))
+	req.Header.Set(signing.KeyIdHeader, s.keyId)
+	req.Header.Set(signing.TimestampHeader, timestamp)
+	req.Header.Set(signing.NonceHeader, s.nonce)
+	req.Header.Set(signing.SignatureHeader, signing.Signature(signing.DeriveKey(testSecret), message))
+	return req
+}
+
+func TestAuthMiddlewareSignedRequests(t *testing.T) {
+	valid := signedRequest{
+		keyId:     testKeyId,
+		timestamp: time.Now(),
+		nonce:     "0123456789abcdef",
+		signed:    "username=arman",
+		sent:      "username=arman",
+	}
+
+	tests := []struct {
+		name       string
+		modify     func(s *signedRequest)
+		wantStatus int
+		wantBody   string
+	}{
+		{"valid", func(s *signedRequest) {}, http.StatusOK, "mobile"},
+		{"client requiring signatures", func(s *signedRequest) { s.keyId = "signonly" }, http.StatusOK, "batch"},
+		{"slightly in the future", func(s *signedRequest) { s.timestamp = time.Now().Add(time.Minute) }, http.StatusOK, "mobile"},
+		{"stale timestamp", func(s *signedRequest) { s.timestamp = time.Now().Add(-time.Hour) }, http.StatusUnauthorized, "too far from the server time"},
+		{"future timestamp", func(s *signedRequest) { s.timestamp = time.Now().Add(time.Hour) }, http.StatusUnauthorized, "too far from the server time"},
+		{"short nonce", func(s *signedRequest) { s.nonce = "0123" }, http.StatusUnauthorized, "X-Nonce"},
+		{"tampered body", func(s *signedRequest) { s.sent = "username=other" }, http.StatusUnauthorized, "Invalid request signature"},
+		{"unknown key", func(s *signedRequest) { s.keyId = "unknown" }, http.StatusUnauthorized, "Invalid request signature"},
+		{"key without signing key", func(s *signedRequest) { s.keyId = "oldkey" }, http.StatusUnauthorized, "rotate it"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := valid
+			s.nonce = strconv.Itoa(i) + valid.nonce
+			tt.modify(&s)
+
+			w := httptest.NewRecorder()
+			newTestRouter().ServeHTTP(w, s.build())
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %s, want %d containing %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareRejectsReplay(t *testing.T) {
+	r := newTestRouter()
+	s := signedRequest{
+		keyId:     testKeyId,
+		timestamp: time.Now(),
+		nonce:     "fedcba9876543210",
+		signed:    "username=arman",
+		sent:      "username=arman",
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, s.build())
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, s.build())
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "already used") {
+		t.Errorf("replay got %d %s, want 401", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthMiddlewareSecurityCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"valid key", testKeyId + "." + testSecret, http.StatusOK, "mobile"},
+		{"missing", "", http.StatusUnauthorized, "Security-Code header is required"},
+		{"wrong secret", testKeyId + ".wrong", http.StatusUnauthorized, "Invalid Security-Code"},
+		{"client requiring signatures", "signonly." + testSecret, http.StatusUnauthorized, "must be signed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/face/validate/image", nil)
+			if tt.header != "" {
+				req.Header.Set("Security-Code", tt.header)
+			}
+			w := httptest.NewRecorder()
+			newTestRouter().ServeHTTP(w, req)
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %s, want %d containing %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
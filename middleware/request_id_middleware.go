@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RequestIdHeader = "X-Request-ID"
+
+// RequestIdMiddleware tags every request with an id, taken from the
+// X-Request-ID header when the caller sends one, and its start time.
+func RequestIdMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("request_start", time.Now())
+
+		requestId := c.GetHeader(RequestIdHeader)
+		if requestId == "" || len(requestId) > 128 {
+			b := make([]byte, 16)
+			rand.Read(b)
+			requestId = hex.EncodeToString(b)
+		}
+		c.Set("request_id", requestId)
+		c.Header(RequestIdHeader, requestId)
+
+		// Continue to the next middleware/handler
+		c.Next()
+	}
+}
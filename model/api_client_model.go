@@ -0,0 +1,48 @@
+package model
+
+import "time"
+
+// API client scopes. admin grants every other scope too.
+const (
+	ScopeEnroll = "enroll"
+	ScopeVerify = "verify"
+	ScopeAdmin  = "admin"
+)
+
+// ApiClient is a named caller of the API, e.g. the mobile app or a batch
+// job, with the scopes it is allowed to use.
+type ApiClient struct {
+	Name        string   `json:"name" bson:"_id"`
+	Description string   `json:"description" bson:"description"`
+	Scopes      []string `json:"scopes" bson:"scopes"`
+	// RequireSignature refuses requests of the client that aren't signed,
+	// see package signing.
+	RequireSignature bool     `json:"require_signature" bson:"require_signature"`
+	Keys             []ApiKey `json:"keys" bson:"keys"`
+	// Revision is incremented by every change of Keys, to detect concurrent
+	// rotations and revocations.
+	Revision  int       `json:"revision" bson:"revision"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// ApiKey is one key of a client. Only the SHA-256 of its secret is stored,
+// and its request signing key encrypted with SIGNING_KEY_ENCRYPTION_KEY.
+// Keys replaced by a rotation keep working until ExpiresAt, zero means the
+// key never expires.
+type ApiKey struct {
+	Id         string    `json:"id" bson:"id"`
+	Hash       string    `json:"-" bson:"hash"`
+	SigningKey string    `json:"-" bson:"signing_key,omitempty"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// HasScope reports whether the client may use scope.
+func (c ApiClient) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+// FaceAudit records one enrollment, verification or management operation
+// on a user's face key.
+type FaceAudit struct {
+	Action    string           `json:"action" bson:"action"`
+	Username  string           `json:"username" bson:"username"`
+	Outcome   string           `json:"outcome" bson:"outcome"`
+	Decision  string           `json:"decision,omitempty" bson:"decision,omitempty"`
+	Status    int              `json:"status" bson:"status"`
+	Message   string           `json:"message,omitempty" bson:"message,omitempty"`
+	Distance  *float32         `json:"distance,omitempty" bson:"distance,omitempty"`
+	Threshold *float32         `json:"threshold,omitempty" bson:"threshold,omitempty"`
+	Metric    string           `json:"metric,omitempty" bson:"metric,omitempty"`
+	Spoof     *FaceSpoofScores `json:"spoof,omitempty" bson:"spoof,omitempty"`
+	Client    string           `json:"client" bson:"client"`
+	ClientIP  string           `json:"client_ip" bson:"client_ip"`
+	UserAgent string           `json:"user_agent" bson:"user_agent"`
+	RequestId string           `json:"request_id" bson:"request_id"`
+	LatencyMs int64            `json:"latency_ms" bson:"latency_ms"`
+	CreatedAt time.Time        `json:"created_at" bson:"created_at"`
+}
+
+// FaceSpoofScores are the passive presentation attack scores of an image,
+// from 0 (looks genuine) to 1 (looks like a spoof).
+type FaceSpoofScores struct {
+	Moire     float32 `json:"moire" bson:"moire"`
+	Specular  float32 `json:"specular" bson:"specular"`
+	Color     float32 `json:"color" bson:"color"`
+	FaceRatio float32 `json:"face_ratio" bson:"face_ratio"`
+	Overall   float32 `json:"overall" bson:"overall"`
+	Suspected bool    `json:"suspected" bson:"suspected"`
+}
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// FaceLivenessChallenge is a one-time list of actions a user has to perform
+// on camera before a liveness verification.
+type FaceLivenessChallenge struct {
+	Id        string    `json:"challenge_id" bson:"_id"`
+	Username  string    `json:"username" bson:"username"`
+	Actions   []string  `json:"actions" bson:"actions"`
+	Used      bool      `json:"-" bson:"used"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// FaceLockout tracks failed verifications of one subject, a username or a
+// device/IP, and the lockout they triggered.
+type FaceLockout struct {
+	Key          string    `json:"key" bson:"_id"`
+	Failures     int       `json:"failures" bson:"failures"`
+	WindowStart  time.Time `json:"window_start" bson:"window_start"`
+	LockoutCount int       `json:"lockout_count" bson:"lockout_count"`
+	LockedUntil  time.Time `json:"locked_until" bson:"locked_until"`
+	UpdatedAt    time.Time `json:"updated_at" bson:"updated_at"`
+}
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+const (
+	ThresholdPolicyScopeUser = "user"
+	ThresholdPolicyScopeRole = "role"
+)
+
+// FaceThresholdPolicy overrides the match threshold for one user or for
+// every user of a role. Threshold is a Euclidean distance.
+type FaceThresholdPolicy struct {
+	Scope     string    `json:"scope" bson:"scope"`
+	Subject   string    `json:"subject" bson:"subject"`
+	Threshold float32   `json:"threshold" bson:"threshold"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
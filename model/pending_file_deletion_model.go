@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// PendingFileDeletion is a stored file that is no longer referenced and
+// still has to be removed from storage.
+type PendingFileDeletion struct {
+	FileName      string    `json:"file_name" bson:"file_name"`
+	Reason        string    `json:"reason" bson:"reason"`
+	Attempts      int       `json:"attempts" bson:"attempts"`
+	LastError     string    `json:"last_error" bson:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at" bson:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+}
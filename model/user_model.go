@@ -1,13 +1,61 @@
 package model
 
+import "time"
+
+// PrimaryFaceTemplateId identifies the template stored in the legacy
+// go_face_embedding / go_face_image_url fields.
+const PrimaryFaceTemplateId = "primary"
+
 type User struct {
-	Id              int    `json:"id" db:"id" bson:"id"`
-	Username        string `json:"username" db:"username" bson:"username"`
-	Nik             string `json:"nik" db:"nik" bson:"nik"`
-	FullName        string `json:"full_name" db:"full_name" bson:"full_name"`
-	Email           string `json:"email" db:"email" bson:"email"`
-	Phone           string `json:"phone" db:"phone" bson:"phone"`
-	IsActive        bool   `json:"is_active" db:"is_active" bson:"is_active"`
-	GoFaceEmbedding string `json:"go_face_embedding" db:"go_face_embedding" bson:"go_face_embedding"`
-	GoFaceImageUrl  string `json:"go_face_image_url" db:"go_face_image_url" bson:"go_face_image_url"`
+	Id              int            `json:"id" db:"id" bson:"id"`
+	Username        string         `json:"username" db:"username" bson:"username"`
+	Nik             string         `json:"nik" db:"nik" bson:"nik"`
+	FullName        string         `json:"full_name" db:"full_name" bson:"full_name"`
+	Email           string         `json:"email" db:"email" bson:"email"`
+	Phone           string         `json:"phone" db:"phone" bson:"phone"`
+	IsActive        bool           `json:"is_active" db:"is_active" bson:"is_active"`
+	Role            string         `json:"role" db:"role" bson:"role,omitempty"`
+	GoFaceEmbedding string         `json:"go_face_embedding" db:"go_face_embedding" bson:"go_face_embedding"`
+	GoFaceImageUrl  string         `json:"go_face_image_url" db:"go_face_image_url" bson:"go_face_image_url"`
+	GoFaceTemplates []FaceTemplate `json:"go_face_templates" db:"go_face_templates" bson:"go_face_templates,omitempty"`
+	GoFaceRevision  int            `json:"go_face_revision" db:"go_face_revision" bson:"go_face_revision"`
+	// GoFaceRecognizer produced the primary embedding, nil for face keys
+	// saved before it was recorded.
+	GoFaceRecognizer *RecognizerParams `json:"go_face_recognizer,omitempty" db:"-" bson:"go_face_recognizer,omitempty"`
+}
+
+type FaceTemplate struct {
+	Id        string    `json:"id" bson:"id"`
+	ImageUrl  string    `json:"image_url" bson:"image_url"`
+	Embedding string    `json:"embedding" bson:"embedding"`
+	Source    string    `json:"source" bson:"source"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	// Recognizer produced the embedding, nil for templates saved before it
+	// was recorded.
+	Recognizer *RecognizerParams `json:"recognizer,omitempty" bson:"recognizer,omitempty"`
+}
+
+// RecognizerParams configure how go-face turns a detected face into an
+// embedding: the side of the aligned face chip, the padding around the face
+// in it and how many jittered copies are averaged.
+type RecognizerParams struct {
+	Size      int     `json:"size" bson:"size"`
+	Padding   float32 `json:"padding" bson:"padding"`
+	Jittering int     `json:"jittering" bson:"jittering"`
+}
+
+// FaceTemplates returns every enrolled template of the user, starting with
+// the primary face key saved through the legacy fields.
+func (u User) FaceTemplates() []FaceTemplate {
+	templates := make([]FaceTemplate, 0, len(u.GoFaceTemplates)+1)
+	if u.GoFaceEmbedding != "" {
+		templates = append(templates, FaceTemplate{
+			Id:         PrimaryFaceTemplateId,
+			ImageUrl:   u.GoFaceImageUrl,
+			Embedding:  u.GoFaceEmbedding,
+			Source:     "save",
+			Recognizer: u.GoFaceRecognizer,
+		})
+	}
+	return append(templates, u.GoFaceTemplates...)
 }
@@ -1,23 +1,117 @@
 package router
 
 import (
+	"arkan-face-key/config"
 	"arkan-face-key/handler"
+	"arkan-face-key/middleware"
+	"arkan-face-key/model"
 	"arkan-face-key/service"
+	"arkan-face-key/storage"
+	"context"
+	"log"
 
 	"github.com/gin-gonic/gin"
-	"github.com/pkg/sftp"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func SetupFaceRecognitionRouter(r *gin.Engine, mongo *mongo.Client, sftp *sftp.Client) {
-	sftpService := service.NewSftpService(sftp)
-	faceService := service.NewFaceRecognitionService(mongo, sftpService)
+func SetupFaceRecognitionRouter(ctx context.Context, r *gin.Engine, mongo *mongo.Client, store storage.Storage, recognizerPools service.RecognizerPools, apiClientService service.ApiClientService) {
+	fileService := service.NewFileService(store)
+	fileCleaner := service.NewFileCleaner(mongo, fileService)
+	go fileCleaner.Run(ctx)
+
+	faceIndex := service.NewFaceIndex(mongo)
+	if err := faceIndex.Reload(ctx); err != nil {
+		log.Fatalf("Failed to load face embeddings index: %v", err)
+	}
+	go faceIndex.Run(ctx)
+
+	idempotencyStore := service.NewIdempotencyStore(mongo)
+	if err := idempotencyStore.EnsureIndexes(ctx); err != nil {
+		log.Printf("Failed to create idempotency indexes: %v", err)
+	}
+
+	auditLog := service.NewAuditLog(mongo)
+	if err := auditLog.EnsureIndexes(ctx); err != nil {
+		log.Printf("Failed to create face audit indexes: %v", err)
+	}
+
+	lockoutService := service.NewLockoutService(mongo)
+
+	thresholdPolicy := service.NewThresholdPolicy(mongo)
+	if err := thresholdPolicy.EnsureIndexes(ctx); err != nil {
+		log.Printf("Failed to create threshold policy indexes: %v", err)
+	}
+
+	if err := apiClientService.EnsureIndexes(ctx); err != nil {
+		log.Printf("Failed to create API client indexes: %v", err)
+	}
+
+	verificationTokens, err := service.NewVerificationTokenService()
+	if err != nil {
+		log.Fatalf("Failed to load verification token key: %v", err)
+	}
+
+	livenessService, err := service.NewLivenessService(mongo)
+	if err != nil {
+		log.Fatalf("Invalid liveness configuration: %v", err)
+	}
+	if err := livenessService.EnsureIndexes(ctx); err != nil {
+		log.Printf("Failed to create liveness challenge indexes: %v", err)
+	}
+
+	faceDetector, err := service.NewFaceDetector(config.FACE_DETECTOR)
+	if err != nil {
+		log.Fatalf("Invalid face detector configuration: %v", err)
+	}
+
+	faceService := service.NewFaceRecognitionService(mongo, fileService, fileCleaner, recognizerPools, faceIndex, idempotencyStore, auditLog, lockoutService, thresholdPolicy, verificationTokens, livenessService, faceDetector)
 	faceHandler := handler.NewFaceRecognitionHandler(faceService)
+	auditHandler := handler.NewFaceAuditHandler(auditLog)
+	thresholdPolicyHandler := handler.NewFaceThresholdPolicyHandler(thresholdPolicy)
+	apiClientHandler := handler.NewApiClientHandler(apiClientService)
+	tokenHandler := handler.NewVerificationTokenHandler(verificationTokens)
+	detectorHandler := handler.NewFaceDetectorHandler(faceDetector)
 
 	api := r.Group("/api")
+
+	// Any API client may fetch the key to check verification tokens offline
+	api.GET("/face/token/jwks", tokenHandler.GetJWKS)
+
+	// Detection touches no user, any API client may debug its photos
+	api.POST("/face/detect", faceHandler.DetectFaces)
+
+	enroll := api.Group("", middleware.RequireScope(model.ScopeEnroll))
+	{
+		enroll.POST("/face/save", faceHandler.SaveUserFaceKey)
+		enroll.POST("/face/templates", faceHandler.AddFaceTemplate)
+		enroll.GET("/face/templates/:username", faceHandler.ListFaceTemplates)
+		enroll.DELETE("/face/templates/:username/:template_id", faceHandler.RemoveFaceTemplate)
+		enroll.GET("/face/:username", faceHandler.GetFaceKeyStatus)
+		enroll.DELETE("/face/:username", faceHandler.DeleteFaceKey)
+	}
+
+	verify := api.Group("", middleware.RequireScope(model.ScopeVerify))
+	{
+		verify.POST("/face/validate/embedding", faceHandler.ValidateWithEmbedding)
+		verify.POST("/face/validate/image", faceHandler.ValidateWithImage)
+		verify.POST("/face/liveness/challenge", faceHandler.IssueLivenessChallenge)
+		verify.POST("/face/validate/liveness", faceHandler.ValidateWithLiveness)
+		verify.POST("/face/identify", faceHandler.Identify)
+		verify.POST("/face/compare", faceHandler.CompareFaces)
+		verify.POST("/face/token/verify", tokenHandler.VerifyToken)
+	}
+
+	admin := api.Group("", middleware.RequireScope(model.ScopeAdmin))
 	{
-		api.POST("/face/save", faceHandler.SaveUserFaceKey)
-		api.POST("/face/validate/embedding", faceHandler.ValidateWithEmbedding)
-		api.POST("/face/validate/image", faceHandler.ValidateWithImage)
+		admin.GET("/face/audit", auditHandler.GetAuditLog)
+		admin.DELETE("/face/lockout/:username", faceHandler.ClearLockout)
+		admin.GET("/face/detector/metrics", detectorHandler.GetMetrics)
+		admin.GET("/face/threshold-policy", thresholdPolicyHandler.ListThresholdPolicies)
+		admin.PUT("/face/threshold-policy/:scope/:subject", thresholdPolicyHandler.SetThresholdPolicy)
+		admin.DELETE("/face/threshold-policy/:scope/:subject", thresholdPolicyHandler.DeleteThresholdPolicy)
+		admin.GET("/clients", apiClientHandler.ListClients)
+		admin.POST("/clients", apiClientHandler.CreateClient)
+		admin.POST("/clients/:name/keys", apiClientHandler.RotateKey)
+		admin.DELETE("/clients/:name/keys/:key_id", apiClientHandler.RevokeKey)
 	}
 }
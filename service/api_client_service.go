@@ -0,0 +1,419 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"arkan-face-key/signing"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const apiClientCollection = "face_api_client"
+
+// Names of the clients authenticated with the legacy SECURITY_CODE and
+// ADMIN_SECURITY_CODE while callers migrate to their own keys.
+const (
+	LegacyClientName      = "legacy"
+	LegacyAdminClientName = "legacy-admin"
+)
+
+var (
+	ErrSigningDisabled = errors.New("request signing is disabled, SIGNING_KEY_ENCRYPTION_KEY is not set")
+	ErrNoSigningKey    = errors.New("API key was issued without a signing key, rotate it to sign requests")
+)
+
+// ApiClientService authenticates API keys and manages the clients owning
+// them. A key is "<key id>.<secret>", the key id is used to find the client
+// and the secret is compared against its hash in constant time.
+type ApiClientService interface {
+	EnsureIndexes(ctx context.Context) error
+	// Authenticate returns the client owning key, nil when the key is
+	// unknown, revoked or expired.
+	Authenticate(ctx context.Context, key string) (*model.ApiClient, error)
+	// FindKey returns the client owning a key and the key, nil when the key
+	// is unknown, revoked or expired.
+	FindKey(ctx context.Context, keyId string) (*model.ApiClient, *model.ApiKey, error)
+	// SigningKey decrypts the request signing key of apiKey, see package
+	// signing.
+	SigningKey(apiKey *model.ApiKey) (string, error)
+	ListClients(r *gin.Context) (*helper.Response, *helper.Response)
+	CreateClient(r *gin.Context, name string, description string, scopes []string, requireSignature bool) (*helper.Response, *helper.Response)
+	RotateKey(r *gin.Context, name string) (*helper.Response, *helper.Response)
+	RevokeKey(r *gin.Context, name string, keyId string) (*helper.Response, *helper.Response)
+}
+
+type apiClientService struct {
+	mongo *mongo.Client
+	// signingKeys encrypts the signing keys of API keys, nil when request
+	// signing is disabled.
+	signingKeys cipher.AEAD
+}
+
+// NewApiClientService reads SIGNING_KEY_ENCRYPTION_KEY, 32 hex encoded
+// bytes. Without it keys get no signing key and signed requests are
+// refused.
+func NewApiClientService(mongo *mongo.Client) (ApiClientService, error) {
+	s := &apiClientService{mongo: mongo}
+	if config.SIGNING_KEY_ENCRYPTION_KEY == "" {
+		return s, nil
+	}
+
+	key, err := hex.DecodeString(config.SIGNING_KEY_ENCRYPTION_KEY)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("SIGNING_KEY_ENCRYPTION_KEY must be 32 hex encoded bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	s.signingKeys, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *apiClientService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    map[string]any{"keys.id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (s *apiClientService) Authenticate(ctx context.Context, key string) (*model.ApiClient, error) {
+	if client := legacyClient(key); client != nil {
+		return client, nil
+	}
+
+	keyId, secret, ok := strings.Cut(key, ".")
+	if !ok || keyId == "" || secret == "" {
+		return nil, nil
+	}
+
+	client, apiKey, err := s.FindKey(ctx, keyId)
+	if client == nil || err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(apiKey.Hash)) != 1 {
+		return nil, nil
+	}
+	return client, nil
+}
+
+func (s *apiClientService) FindKey(ctx context.Context, keyId string) (*model.ApiClient, *model.ApiKey, error) {
+	var client model.ApiClient
+	err := s.collection().FindOne(ctx, map[string]any{"keys.id": keyId}).Decode(&client)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, apiKey := range client.Keys {
+		if apiKey.Id != keyId {
+			continue
+		}
+		if !apiKey.ExpiresAt.IsZero() && time.Now().After(apiKey.ExpiresAt) {
+			return nil, nil, nil
+		}
+		return &client, &apiKey, nil
+	}
+	return nil, nil, nil
+}
+
+func (s *apiClientService) SigningKey(apiKey *model.ApiKey) (string, error) {
+	if s.signingKeys == nil {
+		return "", ErrSigningDisabled
+	}
+	if apiKey.SigningKey == "" {
+		return "", ErrNoSigningKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(apiKey.SigningKey)
+	nonceSize := s.signingKeys.NonceSize()
+	if err != nil || len(sealed) < nonceSize {
+		return "", fmt.Errorf("invalid signing key of API key %s", apiKey.Id)
+	}
+	key, err := s.signingKeys.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(apiKey.Id))
+	if err != nil {
+		return "", fmt.Errorf("decrypting signing key of API key %s: %w", apiKey.Id, err)
+	}
+	return string(key), nil
+}
+
+// legacyClient maps the shared security codes to built-in clients, nil when
+// key is neither.
+func legacyClient(key string) *model.ApiClient {
+	if config.ADMIN_SECURITY_CODE != "" && subtle.ConstantTimeCompare([]byte(key), []byte(config.ADMIN_SECURITY_CODE)) == 1 {
+		return &model.ApiClient{Name: LegacyAdminClientName, Scopes: []string{model.ScopeAdmin}}
+	}
+	if config.SECURITY_CODE != "" && subtle.ConstantTimeCompare([]byte(key), []byte(config.SECURITY_CODE)) == 1 {
+		return &model.ApiClient{Name: LegacyClientName, Scopes: []string{model.ScopeEnroll, model.ScopeVerify}}
+	}
+	return nil
+}
+
+func (s *apiClientService) ListClients(r *gin.Context) (*helper.Response, *helper.Response) {
+	cursor, err := s.collection().Find(r, map[string]any{}, options.Find().SetSort(map[string]any{"_id": 1}))
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error listing API clients: %v", err),
+		}
+	}
+
+	clients := []model.ApiClient{}
+	if err := cursor.All(r, &clients); err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error decoding API clients: %v", err),
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "API clients retrieved successfully",
+		Data:    clients,
+	}, nil
+}
+
+func (s *apiClientService) CreateClient(r *gin.Context, name string, description string, scopes []string, requireSignature bool) (*helper.Response, *helper.Response) {
+	if name == "" || name == LegacyClientName || name == LegacyAdminClientName {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "Invalid client name",
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "At least one scope is required",
+		}
+	}
+	if requireSignature && s.signingKeys == nil {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "Clients can't require signatures while request signing is disabled",
+		}
+	}
+	for _, scope := range scopes {
+		if scope != model.ScopeEnroll && scope != model.ScopeVerify && scope != model.ScopeAdmin {
+			return nil, &helper.Response{
+				Status:  400,
+				Message: fmt.Sprintf("Unknown scope %q, expected %s, %s or %s", scope, model.ScopeEnroll, model.ScopeVerify, model.ScopeAdmin),
+			}
+		}
+	}
+
+	apiKey, key, err := s.newApiKey()
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error generating API key: %v", err),
+		}
+	}
+
+	client := model.ApiClient{
+		Name:             name,
+		Description:      description,
+		Scopes:           scopes,
+		RequireSignature: requireSignature,
+		Keys:             []model.ApiKey{apiKey},
+		CreatedAt:        apiKey.CreatedAt,
+	}
+	if _, err := s.collection().InsertOne(r, client); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, &helper.Response{
+				Status:  409,
+				Message: "API client already exists",
+			}
+		}
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error creating API client: %v", err),
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "API client created successfully, the key is only shown once",
+		Data: map[string]any{
+			"client": client,
+			"key":    key,
+		},
+	}, nil
+}
+
+// RotateKey adds a new key to the client. Its current keys keep working for
+// API_KEY_ROTATION_OVERLAP so callers can switch over without downtime.
+func (s *apiClientService) RotateKey(r *gin.Context, name string) (*helper.Response, *helper.Response) {
+	var client model.ApiClient
+	err := s.collection().FindOne(r, map[string]any{"_id": name}).Decode(&client)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, &helper.Response{
+			Status:  404,
+			Message: "API client not found",
+		}
+	}
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error getting API client: %v", err),
+		}
+	}
+
+	apiKey, key, err := s.newApiKey()
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error generating API key: %v", err),
+		}
+	}
+
+	// Expire the current keys after the overlap, unless they expire sooner
+	overlapEnd := apiKey.CreatedAt.Add(config.API_KEY_ROTATION_OVERLAP)
+	keys := []model.ApiKey{}
+	for _, old := range client.Keys {
+		if !old.ExpiresAt.IsZero() && old.ExpiresAt.Before(apiKey.CreatedAt) {
+			continue
+		}
+		if old.ExpiresAt.IsZero() || old.ExpiresAt.After(overlapEnd) {
+			old.ExpiresAt = overlapEnd
+		}
+		keys = append(keys, old)
+	}
+	keys = append(keys, apiKey)
+
+	// Store the keys only if no other rotation or revocation changed them
+	// since they were read, or the new key of one of them would be lost
+	result, err := s.collection().UpdateOne(r, clientRevisionFilter(client), map[string]any{
+		"$set": map[string]any{"keys": keys},
+		"$inc": map[string]any{"revision": 1},
+	})
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error rotating API key: %v", err),
+		}
+	}
+	if result.MatchedCount == 0 {
+		return nil, &helper.Response{
+			Status:  409,
+			Message: "API keys were changed by another request, please try again",
+		}
+	}
+	client.Keys = keys
+	client.Revision++
+
+	return &helper.Response{
+		Status:  200,
+		Message: "API key rotated successfully, the key is only shown once",
+		Data: map[string]any{
+			"client": client,
+			"key":    key,
+		},
+	}, nil
+}
+
+// RevokeKey removes a key right away, e.g. when it leaked.
+func (s *apiClientService) RevokeKey(r *gin.Context, name string, keyId string) (*helper.Response, *helper.Response) {
+	result, err := s.collection().UpdateOne(
+		r,
+		map[string]any{"_id": name, "keys.id": keyId},
+		map[string]any{
+			"$pull": map[string]any{"keys": map[string]any{"id": keyId}},
+			"$inc":  map[string]any{"revision": 1},
+		},
+	)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error revoking API key: %v", err),
+		}
+	}
+	if result.MatchedCount == 0 {
+		return nil, &helper.Response{
+			Status:  404,
+			Message: "API key not found",
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "API key revoked successfully",
+	}, nil
+}
+
+// clientRevisionFilter matches the client only while its keys are unchanged
+// since it was read. Clients created before revisions existed have no
+// revision field yet.
+func clientRevisionFilter(client model.ApiClient) map[string]any {
+	filter := map[string]any{
+		"_id":      client.Name,
+		"revision": client.Revision,
+	}
+	if client.Revision == 0 {
+		filter["revision"] = map[string]any{"$in": []any{0, nil}}
+	}
+	return filter
+}
+
+func (s *apiClientService) collection() *mongo.Collection {
+	return s.mongo.Database(config.MONGO_DB).Collection(apiClientCollection)
+}
+
+// newApiKey generates a key, returning the record to store and the key to
+// hand out.
+func (s *apiClientService) newApiKey() (model.ApiKey, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return model.ApiKey{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return model.ApiKey{}, "", err
+	}
+
+	apiKey := model.ApiKey{
+		Id:        hex.EncodeToString(id),
+		CreatedAt: time.Now().In(config.JakartaLocation),
+	}
+	secretStr := base64.RawURLEncoding.EncodeToString(secret)
+	apiKey.Hash = hashApiKeySecret(secretStr)
+
+	// Keep the signing key encrypted, bound to the key id
+	if s.signingKeys != nil {
+		nonce := make([]byte, s.signingKeys.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return model.ApiKey{}, "", err
+		}
+		sealed := s.signingKeys.Seal(nonce, nonce, []byte(signing.DeriveKey(secretStr)), []byte(apiKey.Id))
+		apiKey.SigningKey = base64.StdEncoding.EncodeToString(sealed)
+	}
+	return apiKey, apiKey.Id + "." + secretStr, nil
+}
+
+// hashApiKeySecret hashes a secret to look it up. The secrets are random, so
+// a plain SHA-256 is enough. It is only used for lookup, signatures are
+// keyed with the signing key.
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const faceAuditCollection = "face_audit"
+
+// Audit outcomes: the operation succeeded, was refused (no match, no face,
+// conflict, ...) or failed on our side.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeError   = "error"
+)
+
+// AuditLog keeps a trail of enrollments, verifications and other
+// operations on face keys in Mongo.
+type AuditLog interface {
+	EnsureIndexes(ctx context.Context) error
+	Record(r *gin.Context, entry model.FaceAudit)
+	RecordResult(r *gin.Context, action string, username string, res *helper.Response, errRes *helper.Response)
+	Query(r *gin.Context, query dto.FaceAuditQuery) (*helper.Response, *helper.Response)
+}
+
+type auditLog struct {
+	mongo *mongo.Client
+}
+
+func NewAuditLog(mongo *mongo.Client) AuditLog {
+	return &auditLog{mongo: mongo}
+}
+
+func (a *auditLog) EnsureIndexes(ctx context.Context) error {
+	_, err := a.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: map[string]any{"created_at": -1}},
+		{Keys: map[string]any{"username": 1, "created_at": -1}},
+	})
+	return err
+}
+
+// Record fills in the request details and stores entry. Failing to write
+// the audit trail is logged but never fails the request itself.
+func (a *auditLog) Record(r *gin.Context, entry model.FaceAudit) {
+	entry.Client = r.GetString("client_name")
+	entry.ClientIP = r.ClientIP()
+	entry.UserAgent = r.Request.UserAgent()
+	entry.RequestId = r.GetString("request_id")
+	if start, ok := r.Get("request_start"); ok {
+		entry.LatencyMs = time.Since(start.(time.Time)).Milliseconds()
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().In(config.JakartaLocation)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := a.collection().InsertOne(ctx, entry); err != nil {
+		log.Printf("Error writing face audit entry for %s: %v", entry.Username, err)
+	}
+}
+
+// RecordResult audits the outcome of a service call from its responses,
+// including the match details of verifications.
+func (a *auditLog) RecordResult(r *gin.Context, action string, username string, res *helper.Response, errRes *helper.Response) {
+	entry := model.FaceAudit{
+		Action:   action,
+		Username: username,
+		Outcome:  OutcomeSuccess,
+	}
+
+	result := res
+	if errRes != nil {
+		result = errRes
+		entry.Outcome = OutcomeFailure
+		if errRes.Status >= 500 {
+			entry.Outcome = OutcomeError
+		}
+	}
+	if result != nil {
+		entry.Status = result.Status
+		entry.Message = result.Message
+		if data, ok := result.Data.(map[string]any); ok {
+			if match, ok := data["match"].(MatchDetails); ok {
+				entry.Decision = match.Decision
+				entry.Distance = &match.Distance
+				entry.Threshold = &match.Threshold
+				entry.Metric = match.Metric
+				entry.Spoof = match.Spoof
+			} else if decision, ok := data["decision"].(string); ok {
+				entry.Decision = decision
+			}
+		}
+	}
+
+	a.Record(r, entry)
+}
+
+func (a *auditLog) Query(r *gin.Context, query dto.FaceAuditQuery) (*helper.Response, *helper.Response) {
+	filter := map[string]any{}
+	if query.Username != "" {
+		filter["username"] = query.Username
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+	if query.Outcome != "" {
+		filter["outcome"] = query.Outcome
+	}
+	if query.Client != "" {
+		filter["client"] = query.Client
+	}
+	createdAt := map[string]any{}
+	if !query.From.IsZero() {
+		createdAt["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		createdAt["$lte"] = query.To
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+
+	total, err := a.collection().CountDocuments(r, filter)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error counting face audit entries: %v", err),
+		}
+	}
+
+	findOptions := options.Find().
+		SetSort(map[string]any{"created_at": -1}).
+		SetSkip(int64((query.Page - 1) * query.Limit)).
+		SetLimit(int64(query.Limit))
+	cursor, err := a.collection().Find(r, filter, findOptions)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error querying face audit entries: %v", err),
+		}
+	}
+
+	entries := []model.FaceAudit{}
+	if err := cursor.All(r, &entries); err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error decoding face audit entries: %v", err),
+		}
+	}
+	for i := range entries {
+		entries[i].CreatedAt = entries[i].CreatedAt.In(config.JakartaLocation)
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Face audit entries retrieved successfully",
+		Meta: map[string]any{
+			"page":  query.Page,
+			"limit": query.Limit,
+			"total": total,
+		},
+		Data: entries,
+	}, nil
+}
+
+func (a *auditLog) collection() *mongo.Collection {
+	return a.mongo.Database(config.MONGO_DB).Collection(faceAuditCollection)
+}
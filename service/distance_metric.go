@@ -0,0 +1,122 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/Kagami/go-face"
+)
+
+const (
+	MetricEuclidean            = "euclidean"
+	MetricSquaredEuclidean     = "squared_euclidean"
+	MetricCosine               = "cosine"
+	MetricHalfSquaredEuclidean = "half_squared_euclidean"
+)
+
+// defaultEuclideanThreshold is the usual match cut-off for dlib descriptors.
+const defaultEuclideanThreshold = 0.6
+
+// DistanceMetric compares two face descriptors; smaller is more similar.
+type DistanceMetric interface {
+	Name() string
+	Distance(a, b face.Descriptor) float32
+	// DefaultThreshold is the usual match cut-off for dlib descriptors,
+	// all equivalent to a Euclidean distance of 0.6.
+	DefaultThreshold() float32
+	// FromEuclidean converts a Euclidean distance into this metric. Cosine
+	// assumes the roughly unit length descriptors dlib produces.
+	FromEuclidean(distance float32) float32
+}
+
+type distanceMetric struct {
+	name          string
+	distance      func(a, b face.Descriptor) float32
+	fromEuclidean func(distance float32) float32
+}
+
+func (m distanceMetric) Name() string                          { return m.name }
+func (m distanceMetric) Distance(a, b face.Descriptor) float32 { return m.distance(a, b) }
+func (m distanceMetric) FromEuclidean(distance float32) float32 {
+	return m.fromEuclidean(distance)
+}
+func (m distanceMetric) DefaultThreshold() float32 {
+	return m.fromEuclidean(defaultEuclideanThreshold)
+}
+
+var distanceMetrics = map[string]DistanceMetric{
+	MetricEuclidean: distanceMetric{
+		name:          MetricEuclidean,
+		distance:      euclideanDistance,
+		fromEuclidean: func(d float32) float32 { return d },
+	},
+	MetricSquaredEuclidean: distanceMetric{
+		name:          MetricSquaredEuclidean,
+		distance:      squaredEuclideanDistance,
+		fromEuclidean: func(d float32) float32 { return d * d },
+	},
+	MetricCosine: distanceMetric{
+		name:          MetricCosine,
+		distance:      cosineDistance,
+		fromEuclidean: func(d float32) float32 { return d * d * 0.5 },
+	},
+	// Kept for clients tuned against the original ValidateWithEmbedding
+	// numbers, see FACE_METRIC_COMPAT.
+	MetricHalfSquaredEuclidean: distanceMetric{
+		name:          MetricHalfSquaredEuclidean,
+		distance:      halfSquaredEuclideanDistance,
+		fromEuclidean: func(d float32) float32 { return d * d * 0.5 },
+	},
+}
+
+// GetDistanceMetric looks up a metric by name.
+func GetDistanceMetric(name string) (DistanceMetric, error) {
+	metric, ok := distanceMetrics[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown distance metric %q, expected one of %v", name, DistanceMetricNames())
+	}
+	return metric, nil
+}
+
+func DistanceMetricNames() []string {
+	names := make([]string, 0, len(distanceMetrics))
+	for name := range distanceMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func squaredEuclideanDistance(a, b face.Descriptor) float32 {
+	var sum float32
+	for i := range a {
+		diff := a[i] - b[i]
+		sum += diff * diff
+	}
+	return sum
+}
+
+// euclideanDistance calculates the Euclidean distance between two face descriptors.
+func euclideanDistance(a, b face.Descriptor) float32 {
+	return float32(math.Sqrt(float64(squaredEuclideanDistance(a, b))))
+}
+
+// halfSquaredEuclideanDistance is what euclideanDistance used to return.
+func halfSquaredEuclideanDistance(a, b face.Descriptor) float32 {
+	return squaredEuclideanDistance(a, b) * 0.5
+}
+
+// cosineDistance returns 1 - cosine similarity, in the range [0, 2].
+func cosineDistance(a, b face.Descriptor) float32 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 1
+	}
+	return float32(1 - dot/(math.Sqrt(normA)*math.Sqrt(normB)))
+}
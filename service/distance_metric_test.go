@@ -0,0 +1,93 @@
+package service
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Kagami/go-face"
+)
+
+// unitDescriptor is a unit length descriptor at angle degrees in the plane
+// of its first two components.
+func unitDescriptor(degrees float64) face.Descriptor {
+	var d face.Descriptor
+	d[0] = float32(math.Cos(degrees * math.Pi / 180))
+	d[1] = float32(math.Sin(degrees * math.Pi / 180))
+	return d
+}
+
+func TestDistanceMetrics(t *testing.T) {
+	var a, b face.Descriptor
+	a[0], a[1] = 1, 2
+	b[0], b[1] = 4, 6
+
+	tests := []struct {
+		metric string
+		want   float32
+	}{
+		{MetricEuclidean, 5},
+		{MetricSquaredEuclidean, 25},
+		{MetricHalfSquaredEuclidean, 12.5},
+		{MetricCosine, float32(1 - 16/(math.Sqrt(5)*math.Sqrt(52)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metric, func(t *testing.T) {
+			metric, err := GetDistanceMetric(tt.metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := metric.Distance(a, b); !approxEqual(got, tt.want) {
+				t.Errorf("Distance = %v, want %v", got, tt.want)
+			}
+			if got := metric.Distance(a, a); !approxEqual(got, 0) {
+				t.Errorf("Distance to itself = %v, want 0", got)
+			}
+		})
+	}
+}
+
+func TestCosineDistanceOfZeroDescriptor(t *testing.T) {
+	var zero face.Descriptor
+	if got := cosineDistance(zero, unitDescriptor(0)); got != 1 {
+		t.Errorf("cosineDistance of a zero descriptor = %v, want 1", got)
+	}
+}
+
+func TestThresholdConversion(t *testing.T) {
+	tests := []struct {
+		metric           string
+		defaultThreshold float32
+	}{
+		{MetricEuclidean, 0.6},
+		{MetricSquaredEuclidean, 0.36},
+		{MetricCosine, 0.18},
+		{MetricHalfSquaredEuclidean, 0.18},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metric, func(t *testing.T) {
+			metric, err := GetDistanceMetric(tt.metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := metric.DefaultThreshold(); !approxEqual(got, tt.defaultThreshold) {
+				t.Errorf("DefaultThreshold = %v, want %v", got, tt.defaultThreshold)
+			}
+
+			// A converted Euclidean distance is the distance in the metric,
+			// exactly for unit length descriptors
+			for _, degrees := range []float64{0, 10, 35, 60, 90} {
+				a, b := unitDescriptor(0), unitDescriptor(degrees)
+				euclidean := euclideanDistance(a, b)
+				if got, want := metric.FromEuclidean(euclidean), metric.Distance(a, b); !approxEqual(got, want) {
+					t.Errorf("FromEuclidean(%v) = %v, want the distance %v at %v°", euclidean, got, want, degrees)
+				}
+			}
+		})
+	}
+}
+
+func TestGetDistanceMetricUnknown(t *testing.T) {
+	if _, err := GetDistanceMetric("manhattan"); err == nil {
+		t.Error("GetDistanceMetric(manhattan) succeeded, want an error")
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"arkan-face-key/helper"
+	"mime/multipart"
+
+	"github.com/Kagami/go-face"
+	"github.com/gin-gonic/gin"
+)
+
+// CompareFaces tells whether two images show the same person, e.g. a
+// selfie and the photo of an ID card during onboarding. No user is
+// involved and neither the images nor their embeddings are stored, the
+// default threshold policy applies.
+func (s *faceRecognitionService) CompareFaces(r *gin.Context, imageA *multipart.FileHeader, imageB *multipart.FileHeader, options dto.FaceMatchOptions) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "compare", "", res, errRes) }()
+
+	// Resolve the metric, this endpoint has no legacy clients to stay
+	// compatible with
+	if options.Metric == "" {
+		options.Metric = config.FACE_DISTANCE_METRIC
+	}
+	metric, legacy, errRes := resolveMetric(options, config.FACE_DISTANCE_METRIC)
+	if errRes != nil {
+		return nil, errRes
+	}
+	threshold, thresholdPolicy, errRes := s.resolveThreshold(r, nil, metric, legacy, options)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Borrow a face recognizer configured for verification from the pool
+	pool := s.recognizerPools.Verify
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
+	}
+	defer pool.Release(rec)
+
+	// Read both images and recognize the face in each
+	faceA, selectionA, errRes := s.detectUploadedFace(rec, imageA, "image_a", options.Selection)
+	if errRes != nil {
+		return nil, errRes
+	}
+	faceB, selectionB, errRes := s.detectUploadedFace(rec, imageB, "image_b", options.Selection)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	distance := metric.Distance(faceA.Descriptor, faceB.Descriptor)
+	decision, message := DecisionMatched, "Faces match"
+	if distance > threshold {
+		decision, message = DecisionNotMatched, "Faces do not match"
+	}
+
+	// Not matching is an answer, not an error: the caller decides what to
+	// do with it
+	return &helper.Response{
+		Status:  200,
+		Message: message,
+		Data: map[string]any{
+			"decision":         decision,
+			"matched":          decision == DecisionMatched,
+			"distance":         distance,
+			"threshold":        threshold,
+			"threshold_policy": thresholdPolicy,
+			"metric":           metric.Name(),
+			"image_a":          selectionA,
+			"image_b":          selectionB,
+		},
+	}, nil
+}
+
+// detectUploadedFace reads an uploaded image and selects its face, naming
+// the form field in errors.
+func (s *faceRecognitionService) detectUploadedFace(rec *face.Recognizer, image *multipart.FileHeader, field string, selection dto.FaceSelection) (face.Face, FaceSelectionResult, *helper.Response) {
+	fileBytes, errRes := readImage(image)
+	if errRes != nil {
+		errRes.Message = field + ": " + errRes.Message
+		return face.Face{}, FaceSelectionResult{}, errRes
+	}
+	f, result, errRes := s.detectFace(rec, fileBytes, selection)
+	if errRes != nil {
+		errRes.Message = field + ": " + errRes.Message
+		return face.Face{}, FaceSelectionResult{}, errRes
+	}
+	return f, result, nil
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"arkan-face-key/helper"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DetectedFace describes a face found by DetectFaces.
+type DetectedFace struct {
+	Index         int           `json:"index"`
+	FaceRectangle FaceRectangle `json:"face_rectangle"`
+	Shapes        []ShapePoint  `json:"shapes"`
+	Pose          FacePose      `json:"pose"`
+	Quality       QualityReport `json:"quality"`
+}
+
+// ShapePoint is a landmark of the face, in pixels of the preprocessed
+// image.
+type ShapePoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// DetectFaces runs the recognizer on an image and describes every face in
+// it, to debug rejected photos and guide the user on the device. It reads
+// and writes no user.
+func (s *faceRecognitionService) DetectFaces(r *gin.Context, image *multipart.FileHeader) (*helper.Response, *helper.Response) {
+	// Borrow a face recognizer configured for verification from the pool
+	pool := s.recognizerPools.Verify
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
+	}
+	defer pool.Release(rec)
+
+	// Read the uploaded image and recognize every face in it
+	fileBytes, errRes := readImage(image)
+	if errRes != nil {
+		return nil, errRes
+	}
+	faces, detector, err := s.faceDetector.Detect(rec, fileBytes)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Error recognizing face in uploaded image: %v", err),
+		}
+	}
+	img, err := jpeg.Decode(bytes.NewReader(fileBytes))
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Error decoding uploaded image: %v", err),
+		}
+	}
+
+	// Number the faces like face selection does
+	sortFaces(faces)
+	detected := make([]DetectedFace, len(faces))
+	for i, f := range faces {
+		detected[i] = DetectedFace{
+			Index:         i,
+			FaceRectangle: NewFaceRectangle(f.Rectangle),
+			Shapes:        shapePoints(f.Shapes),
+			Pose:          estimatePose(f),
+			Quality:       assessFaceQuality(img, f),
+		}
+	}
+
+	message := "Faces detected"
+	if len(faces) == 0 {
+		message = "No faces found in the image"
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: message,
+		Data: map[string]any{
+			"image_width":  img.Bounds().Dx(),
+			"image_height": img.Bounds().Dy(),
+			"face_count":   len(faces),
+			"faces":        detected,
+			"detector":     detector,
+		},
+	}, nil
+}
+
+func shapePoints(shapes []image.Point) []ShapePoint {
+	points := make([]ShapePoint, len(shapes))
+	for i, p := range shapes {
+		points[i] = ShapePoint{X: p.X, Y: p.Y}
+	}
+	return points
+}
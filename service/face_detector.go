@@ -0,0 +1,149 @@
+package service
+
+import (
+	"arkan-face-key/helper"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Kagami/go-face"
+	"github.com/gin-gonic/gin"
+)
+
+// Face detector modes of FACE_DETECTOR.
+const (
+	// DetectorHOG is dlib's HOG detector, fast but misses turned, small
+	// and badly lit faces.
+	DetectorHOG = "hog"
+	// DetectorCNN is the mmod_human_face_detector.dat CNN, more accurate
+	// and several times slower on CPU.
+	DetectorCNN = "cnn"
+	// DetectorHOGThenCNN runs the CNN only when HOG finds no face.
+	DetectorHOGThenCNN = "hog_cnn"
+)
+
+var detectorModes = []string{DetectorHOG, DetectorCNN, DetectorHOGThenCNN}
+
+// DetectorStats are the latency and result counts of one detector since
+// the service started.
+type DetectorStats struct {
+	Runs         int64   `json:"runs"`
+	Errors       int64   `json:"errors"`
+	EmptyResults int64   `json:"empty_results"`
+	Faces        int64   `json:"faces"`
+	TotalMs      float64 `json:"total_ms"`
+	AverageMs    float64 `json:"average_ms"`
+	MaxMs        float64 `json:"max_ms"`
+}
+
+// FaceDetector finds the faces of an image with the configured detector
+// and keeps latency metrics of every detector, to decide where the extra
+// CPU of the CNN is worth it.
+type FaceDetector interface {
+	// Detect returns the faces and the detector that found them.
+	Detect(rec *face.Recognizer, fileBytes []byte) ([]face.Face, string, error)
+	Metrics(r *gin.Context) (*helper.Response, *helper.Response)
+}
+
+type faceDetector struct {
+	mode string
+
+	mu    sync.Mutex
+	stats map[string]*DetectorStats
+	// fallbacks counts CNN runs after HOG found nothing, fallbackHits
+	// those where the CNN found a face.
+	fallbacks    int64
+	fallbackHits int64
+}
+
+func NewFaceDetector(mode string) (FaceDetector, error) {
+	if !isDetectorMode(mode) {
+		return nil, fmt.Errorf("unknown face detector %q, expected one of %v", mode, detectorModes)
+	}
+	return &faceDetector{
+		mode: mode,
+		stats: map[string]*DetectorStats{
+			DetectorHOG: {},
+			DetectorCNN: {},
+		},
+	}, nil
+}
+
+func (d *faceDetector) Detect(rec *face.Recognizer, fileBytes []byte) ([]face.Face, string, error) {
+	if d.mode == DetectorCNN {
+		faces, err := d.run(DetectorCNN, rec.RecognizeCNN, fileBytes)
+		return faces, DetectorCNN, err
+	}
+
+	faces, err := d.run(DetectorHOG, rec.Recognize, fileBytes)
+	if err != nil || len(faces) > 0 || d.mode == DetectorHOG {
+		return faces, DetectorHOG, err
+	}
+
+	// HOG found nothing, try the CNN
+	faces, err = d.run(DetectorCNN, rec.RecognizeCNN, fileBytes)
+	d.mu.Lock()
+	d.fallbacks++
+	if len(faces) > 0 {
+		d.fallbackHits++
+	}
+	d.mu.Unlock()
+	return faces, DetectorCNN, err
+}
+
+// run times one detector and records it.
+func (d *faceDetector) run(detector string, recognize func([]byte) ([]face.Face, error), fileBytes []byte) ([]face.Face, error) {
+	start := time.Now()
+	faces, err := recognize(fileBytes)
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := d.stats[detector]
+	stats.Runs++
+	stats.TotalMs += elapsed
+	stats.MaxMs = max(stats.MaxMs, elapsed)
+	switch {
+	case err != nil:
+		stats.Errors++
+	case len(faces) == 0:
+		stats.EmptyResults++
+	default:
+		stats.Faces += int64(len(faces))
+	}
+	return faces, err
+}
+
+func (d *faceDetector) Metrics(r *gin.Context) (*helper.Response, *helper.Response) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	detectors := map[string]DetectorStats{}
+	for name, stats := range d.stats {
+		snapshot := *stats
+		if snapshot.Runs > 0 {
+			snapshot.AverageMs = snapshot.TotalMs / float64(snapshot.Runs)
+		}
+		detectors[name] = snapshot
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Face detector metrics retrieved successfully",
+		Data: map[string]any{
+			"mode":          d.mode,
+			"detectors":     detectors,
+			"fallbacks":     d.fallbacks,
+			"fallback_hits": d.fallbackHits,
+		},
+	}, nil
+}
+
+func isDetectorMode(mode string) bool {
+	for _, m := range detectorModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
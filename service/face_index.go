@@ -0,0 +1,182 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Kagami/go-face"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// FaceCandidate is one enrolled user ranked by distance to a probe face.
+type FaceCandidate struct {
+	UserId   int     `json:"user_id"`
+	Username string  `json:"username"`
+	FullName string  `json:"full_name"`
+	Distance float32 `json:"distance"`
+}
+
+// FaceIndex keeps every enrolled embedding in memory so 1:N identification
+// doesn't have to scan the user collection on each request. Upsert and
+// Remove only update this instance, Run reloads the index periodically to
+// pick up enrollments handled by other replicas.
+type FaceIndex interface {
+	Reload(ctx context.Context) error
+	Run(ctx context.Context)
+	Upsert(user model.User)
+	Remove(username string)
+	Search(descriptor face.Descriptor, metric DistanceMetric, topK int, threshold float32) []FaceCandidate
+	Len() int
+}
+
+type faceIndexEntry struct {
+	user        model.User
+	descriptors []face.Descriptor
+}
+
+type faceIndex struct {
+	mongo   *mongo.Client
+	mu      sync.RWMutex
+	entries map[string]faceIndexEntry
+}
+
+func NewFaceIndex(mongo *mongo.Client) FaceIndex {
+	return &faceIndex{mongo: mongo, entries: map[string]faceIndexEntry{}}
+}
+
+// Reload replaces the index with the embeddings currently stored in Mongo.
+func (idx *faceIndex) Reload(ctx context.Context) error {
+	collection := idx.mongo.Database(config.MONGO_DB).Collection("user")
+	cursor, err := collection.Find(ctx, map[string]any{
+		"$or": []any{
+			map[string]any{"go_face_embedding": map[string]any{"$nin": []any{"", nil}}},
+			map[string]any{"go_face_templates.0": map[string]any{"$exists": true}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	entries := map[string]faceIndexEntry{}
+	for cursor.Next(ctx) {
+		var user model.User
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		if entry, ok := newFaceIndexEntry(user); ok {
+			entries[user.Username] = entry
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.entries = entries
+	idx.mu.Unlock()
+
+	log.Printf("Loaded %d face embedding(s) into the identification index", len(entries))
+	return nil
+}
+
+// Run reloads the index every FACE_INDEX_RELOAD_INTERVAL until ctx is done,
+// never when the interval is zero.
+func (idx *faceIndex) Run(ctx context.Context) {
+	if config.FACE_INDEX_RELOAD_INTERVAL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(config.FACE_INDEX_RELOAD_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Keep serving the previous index when a reload fails
+		if err := idx.Reload(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error reloading face embeddings index: %v", err)
+		}
+	}
+}
+
+// Upsert refreshes the templates of a single user, dropping the user from
+// the index once no template is left.
+func (idx *faceIndex) Upsert(user model.User) {
+	entry, ok := newFaceIndexEntry(user)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !ok {
+		delete(idx.entries, user.Username)
+		return
+	}
+	idx.entries[user.Username] = entry
+}
+
+func (idx *faceIndex) Remove(username string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.entries, username)
+}
+
+// Search returns up to topK users ordered by ascending distance, combining
+// the templates of a user by FACE_TEMPLATE_AGGREGATION like validation
+// does. A threshold of zero or less disables the distance filter.
+func (idx *faceIndex) Search(descriptor face.Descriptor, metric DistanceMetric, topK int, threshold float32) []FaceCandidate {
+	idx.mu.RLock()
+	candidates := make([]FaceCandidate, 0, len(idx.entries))
+	for _, entry := range idx.entries {
+		distances := make([]float32, len(entry.descriptors))
+		for i, d := range entry.descriptors {
+			distances[i] = metric.Distance(descriptor, d)
+		}
+		distance, _ := aggregateDistances(distances, config.FACE_TEMPLATE_AGGREGATION)
+		if threshold > 0 && distance > threshold {
+			continue
+		}
+		candidates = append(candidates, FaceCandidate{
+			UserId:   entry.user.Id,
+			Username: entry.user.Username,
+			FullName: entry.user.FullName,
+			Distance: distance,
+		})
+	}
+	idx.mu.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Distance < candidates[j].Distance
+	})
+	if topK > 0 && len(candidates) > topK {
+		candidates = candidates[:topK]
+	}
+	return candidates
+}
+
+func newFaceIndexEntry(user model.User) (faceIndexEntry, bool) {
+	entry := faceIndexEntry{user: user}
+	for _, template := range user.FaceTemplates() {
+		descriptor, err := helper.StringToDescriptor(template.Embedding)
+		if err != nil {
+			log.Printf("Skipping invalid face template %s of %s: %v", template.Id, user.Username, err)
+			continue
+		}
+		entry.descriptors = append(entry.descriptors, descriptor)
+	}
+	return entry, len(entry.descriptors) > 0
+}
+
+func (idx *faceIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.entries)
+}
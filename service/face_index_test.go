@@ -0,0 +1,116 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"strconv"
+	"testing"
+
+	"github.com/Kagami/go-face"
+)
+
+// descriptorAt is a descriptor at Euclidean distance d from the zero
+// descriptor.
+func descriptorAt(d float32) face.Descriptor {
+	var descriptor face.Descriptor
+	descriptor[0] = d
+	return descriptor
+}
+
+func indexedUser(t *testing.T, id int, username string, distances ...float32) model.User {
+	user := model.User{Id: id, Username: username}
+	for i, d := range distances {
+		embedding, err := helper.DescriptorToString(descriptorAt(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			user.GoFaceEmbedding = embedding
+			continue
+		}
+		user.GoFaceTemplates = append(user.GoFaceTemplates, model.FaceTemplate{Id: strconv.Itoa(i), Embedding: embedding})
+	}
+	return user
+}
+
+// TestFaceIndexSearchAggregation checks that identification combines the
+// templates like validation does, so a user can't match in one and fail in
+// the other.
+func TestFaceIndexSearchAggregation(t *testing.T) {
+	aggregation := config.FACE_TEMPLATE_AGGREGATION
+	t.Cleanup(func() { config.FACE_TEMPLATE_AGGREGATION = aggregation })
+
+	idx := NewFaceIndex(nil)
+	idx.Upsert(indexedUser(t, 1, "arman", 0.1, 0.7, 0.8))
+	idx.Upsert(indexedUser(t, 2, "budi", 0.4))
+	idx.Upsert(model.User{Id: 3, Username: "no-face"})
+	if idx.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", idx.Len())
+	}
+
+	metric, err := GetDistanceMetric(MetricEuclidean)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"min", []string{"arman", "budi"}},
+		{"mean", []string{"budi", "arman"}},
+		{"median", []string{"budi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			config.FACE_TEMPLATE_AGGREGATION = tt.mode
+			candidates := idx.Search(descriptorAt(0), metric, 5, 0.6)
+
+			var got []string
+			for _, candidate := range candidates {
+				got = append(got, candidate.Username)
+				distances := []float32{}
+				for _, template := range indexedTemplates(t, idx, candidate.Username) {
+					distances = append(distances, metric.Distance(descriptorAt(0), template))
+				}
+				want, _ := aggregateDistances(distances, tt.mode)
+				if !approxEqual(candidate.Distance, want) {
+					t.Errorf("distance of %s = %v, want %v", candidate.Username, candidate.Distance, want)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Search() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Search() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func indexedTemplates(t *testing.T, idx FaceIndex, username string) []face.Descriptor {
+	entry, ok := idx.(*faceIndex).entries[username]
+	if !ok {
+		t.Fatalf("%s is not in the index", username)
+	}
+	return entry.descriptors
+}
+
+func TestFaceIndexRemove(t *testing.T) {
+	idx := NewFaceIndex(nil)
+	idx.Upsert(indexedUser(t, 1, "arman", 0.1))
+	idx.Remove("arman")
+	if idx.Len() != 0 {
+		t.Errorf("Len() = %d after Remove, want 0", idx.Len())
+	}
+
+	// Upserting a user without templates drops it too
+	idx.Upsert(indexedUser(t, 1, "arman", 0.1))
+	idx.Upsert(model.User{Id: 1, Username: "arman"})
+	if idx.Len() != 0 {
+		t.Errorf("Len() = %d after Upsert without templates, want 0", idx.Len())
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"arkan-face-key/helper"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetFaceKeyStatus reports whether the user is enrolled, without exposing
+// the raw embeddings.
+func (s *faceRecognitionService) GetFaceKeyStatus(r *gin.Context, username string) (*helper.Response, *helper.Response) {
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	templates := []map[string]any{}
+	for _, template := range user.FaceTemplates() {
+		templates = append(templates, faceTemplateResponse(template))
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Face key status retrieved successfully",
+		Data: map[string]any{
+			"user_id":        user.Id,
+			"username":       user.Username,
+			"full_name":      user.FullName,
+			"enrolled":       len(templates) > 0,
+			"face_key_file":  user.GoFaceImageUrl,
+			"template_count": len(templates),
+			"templates":      templates,
+			"revision":       user.GoFaceRevision,
+		},
+	}, nil
+}
+
+// DeleteFaceKey removes every face template of the user, e.g. when an
+// employee leaves or asks for their biometric data to be erased.
+func (s *faceRecognitionService) DeleteFaceKey(r *gin.Context, username string) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "delete", username, res, errRes) }()
+
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	templates := user.FaceTemplates()
+	if len(templates) == 0 {
+		return nil, &helper.Response{
+			Status:  404,
+			Message: "User does not have a face key",
+		}
+	}
+
+	// Clear the face key fields, only if nobody changed them since we read them
+	collection := s.users
+	result, err := collection.UpdateOne(r, revisionFilter(user), map[string]any{
+		"$set": map[string]any{
+			"go_face_image_url": "",
+			"go_face_embedding": "",
+		},
+		"$unset": map[string]any{"go_face_templates": "", "go_face_recognizer": ""},
+		"$inc":   map[string]any{"go_face_revision": 1},
+	})
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error deleting face key: %v", err),
+		}
+	}
+	if result.MatchedCount == 0 {
+		return nil, &helper.Response{
+			Status:  409,
+			Message: "Face key was changed by another request, please try again",
+		}
+	}
+
+	// The database no longer references the images, delete them in the background
+	for _, template := range templates {
+		if template.ImageUrl != "" {
+			s.fileCleaner.Schedule(r, template.ImageUrl, "deleted face key")
+		}
+	}
+	s.faceIndex.Remove(user.Username)
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Face key deleted successfully",
+		Data: map[string]any{
+			"user_id":           user.Id,
+			"username":          user.Username,
+			"removed_templates": len(templates),
+			"revision":          user.GoFaceRevision + 1,
+		},
+	}, nil
+}
+
+// ClearLockout lifts the lockout of a username and, when given, of a
+// device or IP.
+func (s *faceRecognitionService) ClearLockout(r *gin.Context, username string, deviceId string, ip string) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "clear_lockout", username, res, errRes) }()
+
+	keys := []string{"user:" + username}
+	if deviceId != "" {
+		keys = append(keys, "device:"+deviceId)
+	}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return s.lockoutService.Clear(r, keys)
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// nopAuditLog drops every entry.
+type nopAuditLog struct {
+	AuditLog
+}
+
+func (nopAuditLog) Record(r *gin.Context, entry model.FaceAudit) {}
+
+func (nopAuditLog) RecordResult(r *gin.Context, action string, username string, res *helper.Response, errRes *helper.Response) {
+}
+
+// recordingCleaner remembers the files scheduled for deletion.
+type recordingCleaner struct {
+	mu        sync.Mutex
+	scheduled []string
+}
+
+func (c *recordingCleaner) Schedule(ctx context.Context, fileName string, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scheduled = append(c.scheduled, fileName)
+}
+
+func (c *recordingCleaner) Run(ctx context.Context) {}
+
+func newFaceKeyTestService(t *testing.T, users ...any) (*faceRecognitionService, *fakeCollection, *recordingCleaner) {
+	t.Helper()
+	collection := newFakeCollection()
+	for _, user := range users {
+		if _, err := collection.InsertOne(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleaner := &recordingCleaner{}
+	return &faceRecognitionService{
+		users:       collection,
+		fileCleaner: cleaner,
+		faceIndex:   NewFaceIndex(nil),
+		auditLog:    nopAuditLog{},
+	}, collection, cleaner
+}
+
+func newFaceKeyTestContext() *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("DELETE", "/api/face/arman", nil)
+	return c
+}
+
+func enrolledUser(revision int) model.User {
+	return model.User{
+		Id:              7,
+		Username:        "arman",
+		GoFaceImageUrl:  "arman_1_face_key.jpeg",
+		GoFaceEmbedding: "[0.1]",
+		GoFaceRevision:  revision,
+		GoFaceTemplates: []model.FaceTemplate{
+			{Id: "t1", ImageUrl: "arman_t1_face_key.jpeg", Embedding: "[0.2]"},
+		},
+	}
+}
+
+// bumpRevision is a concurrent enrollment landing between the read and the
+// guarded write.
+func bumpRevision(collection *fakeCollection) func() {
+	return func() {
+		collection.UpdateOne(context.Background(), map[string]any{"username": "arman"}, map[string]any{
+			"$set": map[string]any{"go_face_embedding": "[0.9]"},
+			"$inc": map[string]any{"go_face_revision": 1},
+		})
+	}
+}
+
+func TestDeleteFaceKey(t *testing.T) {
+	s, collection, cleaner := newFaceKeyTestService(t, enrolledUser(3))
+
+	res, errRes := s.DeleteFaceKey(newFaceKeyTestContext(), "arman")
+	if errRes != nil {
+		t.Fatalf("DeleteFaceKey() error = %+v", errRes)
+	}
+	if data := res.Data.(map[string]any); data["revision"] != 4 || data["removed_templates"] != 2 {
+		t.Errorf("response data = %v", data)
+	}
+
+	user := collection.first(bson.M{"username": "arman"})
+	if user["go_face_embedding"] != "" || user["go_face_templates"] != nil || user["go_face_revision"] != int64(4) {
+		t.Errorf("user after delete = %v", user)
+	}
+	if len(cleaner.scheduled) != 2 {
+		t.Errorf("scheduled %v, want both images", cleaner.scheduled)
+	}
+}
+
+func TestDeleteFaceKeyConflict(t *testing.T) {
+	s, collection, cleaner := newFaceKeyTestService(t, enrolledUser(3))
+	collection.beforeUpdate = bumpRevision(collection)
+
+	_, errRes := s.DeleteFaceKey(newFaceKeyTestContext(), "arman")
+	if errRes == nil || errRes.Status != 409 {
+		t.Fatalf("DeleteFaceKey() error = %+v, want 409", errRes)
+	}
+
+	// The concurrent enrollment is kept and none of its files deleted
+	user := collection.first(bson.M{"username": "arman"})
+	if user["go_face_embedding"] != "[0.9]" {
+		t.Errorf("user after conflict = %v", user)
+	}
+	if len(cleaner.scheduled) != 0 {
+		t.Errorf("scheduled %v after a conflict", cleaner.scheduled)
+	}
+}
+
+func TestRemoveFaceTemplate(t *testing.T) {
+	s, collection, cleaner := newFaceKeyTestService(t, enrolledUser(3))
+
+	if _, errRes := s.RemoveFaceTemplate(newFaceKeyTestContext(), "arman", "t1"); errRes != nil {
+		t.Fatalf("RemoveFaceTemplate() error = %+v", errRes)
+	}
+	user := collection.first(bson.M{"username": "arman"})
+	if templates, _ := user["go_face_templates"].(bson.A); len(templates) != 0 || user["go_face_revision"] != int64(4) {
+		t.Errorf("user after remove = %v", user)
+	}
+	if len(cleaner.scheduled) != 1 || cleaner.scheduled[0] != "arman_t1_face_key.jpeg" {
+		t.Errorf("scheduled %v", cleaner.scheduled)
+	}
+
+	collection.beforeUpdate = bumpRevision(collection)
+	_, errRes := s.RemoveFaceTemplate(newFaceKeyTestContext(), "arman", model.PrimaryFaceTemplateId)
+	if errRes == nil || errRes.Status != 409 {
+		t.Errorf("RemoveFaceTemplate() during a concurrent change error = %+v, want 409", errRes)
+	}
+}
+
+// TestRevisionFilterLegacyUser covers users enrolled before revisions
+// existed, which have no go_face_revision field.
+func TestRevisionFilterLegacyUser(t *testing.T) {
+	legacy := bson.M{"username": "arman", "go_face_embedding": "[0.1]", "go_face_image_url": "arman_1_face_key.jpeg"}
+	s, collection, _ := newFaceKeyTestService(t, legacy)
+
+	if _, errRes := s.DeleteFaceKey(newFaceKeyTestContext(), "arman"); errRes != nil {
+		t.Fatalf("DeleteFaceKey() of a legacy user error = %+v", errRes)
+	}
+	if user := collection.first(bson.M{"username": "arman"}); user["go_face_revision"] != int64(1) {
+		t.Errorf("user after delete = %v", user)
+	}
+
+	tests := []struct {
+		name     string
+		stored   int
+		read     int
+		wantKeep bool
+	}{
+		{"unchanged", 2, 2, true},
+		{"changed", 3, 2, false},
+		{"zero matches zero", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collection := newFakeCollection()
+			collection.InsertOne(context.Background(), bson.M{"username": "arman", "go_face_revision": tt.stored})
+			n, _ := collection.CountDocuments(context.Background(), revisionFilter(model.User{Username: "arman", GoFaceRevision: tt.read}))
+			if (n == 1) != tt.wantKeep {
+				t.Errorf("revisionFilter matched %d documents", n)
+			}
+		})
+	}
+}
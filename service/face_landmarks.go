@@ -0,0 +1,60 @@
+package service
+
+import (
+	"image"
+	"math"
+
+	"github.com/Kagami/go-face"
+)
+
+// landmarks locates the eyes and nose in the Shapes of a face. go-face
+// loads shape_predictor_5_face_landmarks.dat, which has the eye corners and
+// the base of the nose.
+type landmarks struct {
+	rightEye image.Point
+	leftEye  image.Point
+	nose     image.Point
+}
+
+func newLandmarks(f face.Face) (landmarks, bool) {
+	if len(f.Shapes) != 5 {
+		return landmarks{}, false
+	}
+	// 0-1 and 2-3 are the corners of each eye, 4 is below the nose
+	return landmarks{
+		rightEye: midpoint(f.Shapes[0], f.Shapes[1]),
+		leftEye:  midpoint(f.Shapes[2], f.Shapes[3]),
+		nose:     f.Shapes[4],
+	}, true
+}
+
+// yaw estimates the head rotation from how far the nose is off the middle
+// of the eyes, relative to the distance between the eyes. It is about zero
+// facing the camera and grows positive as the nose moves to the right of
+// the image.
+func (l landmarks) yaw() float64 {
+	eyeDistance := pointDistance(l.rightEye, l.leftEye)
+	if eyeDistance == 0 {
+		return 0
+	}
+	eyeCenter := midpoint(l.rightEye, l.leftEye)
+	return float64(l.nose.X-eyeCenter.X) / eyeDistance
+}
+
+// roll is the tilt of the line between the eyes in degrees, zero when
+// they are level.
+func (l landmarks) roll() float64 {
+	a, b := l.rightEye, l.leftEye
+	if a.X > b.X {
+		a, b = b, a
+	}
+	return math.Atan2(float64(b.Y-a.Y), float64(b.X-a.X)) * 180 / math.Pi
+}
+
+func midpoint(a, b image.Point) image.Point {
+	return image.Point{X: (a.X + b.X) / 2, Y: (a.Y + b.Y) / 2}
+}
+
+func pointDistance(a, b image.Point) float64 {
+	return math.Hypot(float64(a.X-b.X), float64(a.Y-b.Y))
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"arkan-face-key/helper"
+	"fmt"
+	"mime/multipart"
+
+	"github.com/Kagami/go-face"
+	"github.com/gin-gonic/gin"
+)
+
+// IssueLivenessChallenge starts a liveness verification of an enrolled
+// user.
+func (s *faceRecognitionService) IssueLivenessChallenge(r *gin.Context, username string) (*helper.Response, *helper.Response) {
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+	if len(user.FaceTemplates()) == 0 {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "User does not have a face key",
+		}
+	}
+
+	return s.livenessService.IssueChallenge(r, user.Username)
+}
+
+// ValidateWithLiveness verifies the user like ValidateWithEmbedding, from
+// the first frame, once the frames show the actions of the challenge
+// performed by that same face. A printed photo can't turn its head.
+func (s *faceRecognitionService) ValidateWithLiveness(r *gin.Context, frames []*multipart.FileHeader, username string, challengeId string, options dto.FaceMatchOptions) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "validate_liveness", username, res, errRes) }()
+
+	// Validate username
+	if username == "" {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "Invalid Username",
+		}
+	}
+
+	// Refuse verification while the user or device is locked out
+	lockoutKeys := LockoutKeys(r, username)
+	if errRes := s.checkLockout(r, lockoutKeys); errRes != nil {
+		return nil, errRes
+	}
+	defer func() { s.recordLockout(r, lockoutKeys, res, errRes) }()
+
+	if len(frames) < config.LIVENESS_MIN_FRAMES || len(frames) > config.LIVENESS_MAX_FRAMES {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Between %d and %d frames are required", config.LIVENESS_MIN_FRAMES, config.LIVENESS_MAX_FRAMES),
+		}
+	}
+
+	// Use up the challenge, so the same frames can't be sent twice
+	challenge, err := s.livenessService.Consume(r, challengeId, username)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error loading liveness challenge: %v", err),
+		}
+	}
+	if challenge == nil {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "Liveness challenge is invalid, expired or already used",
+		}
+	}
+
+	// Resolve the distance metric
+	metric, legacy, errRes := resolveMetric(options, MetricHalfSquaredEuclidean)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Apply the threshold policy of the user
+	threshold, thresholdPolicy, errRes := s.resolveThreshold(r, &user, metric, legacy, options)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Check if user has any enrolled face template
+	templates := user.FaceTemplates()
+	if len(templates) == 0 {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "User does not have a face key",
+		}
+	}
+
+	// Borrow a face recognizer configured for verification from the pool
+	pool := s.recognizerPools.Verify
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
+	}
+	defer pool.Release(rec)
+
+	// Recognize the single face of every frame and locate its landmarks
+	faces := make([]face.Face, len(frames))
+	selections := make([]FaceSelectionResult, len(frames))
+	frameLandmarks := make([]landmarks, len(frames))
+	var firstFrame []byte
+	for i, frame := range frames {
+		fileBytes, errRes := readImage(frame)
+		if errRes != nil {
+			return nil, errRes
+		}
+		if i == 0 {
+			firstFrame = fileBytes
+		}
+		faces[i], selections[i], errRes = s.detectFace(rec, fileBytes, options.Selection)
+		if errRes != nil {
+			errRes.Message = fmt.Sprintf("Frame %d: %s", i+1, errRes.Message)
+			return nil, errRes
+		}
+		var ok bool
+		frameLandmarks[i], ok = newLandmarks(faces[i])
+		if !ok {
+			return nil, &helper.Response{
+				Status:  500,
+				Message: fmt.Sprintf("Unsupported landmark model with %d points", len(faces[i].Shapes)),
+			}
+		}
+	}
+
+	// Check the actions, then that every frame shows the person of the first
+	liveness := LivenessResult{
+		ChallengeId: challenge.Id,
+		Actions:     challenge.Actions,
+		FrameCount:  len(frames),
+	}
+	liveness.Performed, liveness.Reason = checkLiveness(challenge.Actions, frameLandmarks)
+	for i := 1; i < len(faces) && liveness.Reason == ""; i++ {
+		if metric.Distance(faces[0].Descriptor, faces[i].Descriptor) > threshold {
+			liveness.Reason = fmt.Sprintf("frame %d shows a different face", i+1)
+		}
+	}
+	liveness.Passed = liveness.Reason == ""
+
+	// Compare the frontal first frame with every stored template embedding,
+	// and score it for presentation attacks like a validation image: a
+	// replayed video can turn its head
+	distances, errRes := templateDistances(templates, faces[0].Descriptor, metric)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	distance, best := aggregateDistances(distances, config.FACE_TEMPLATE_AGGREGATION)
+	match := MatchDetails{
+		Decision:          DecisionMatched,
+		Distance:          distance,
+		Threshold:         threshold,
+		ThresholdPolicy:   thresholdPolicy,
+		Metric:            metric.Name(),
+		Aggregation:       config.FACE_TEMPLATE_AGGREGATION,
+		FaceRectangle:     NewFaceRectangle(faces[0].Rectangle),
+		FaceSelection:     selections[0],
+		MatchedTemplateId: templates[best].Id,
+		TemplateCount:     len(templates),
+		Liveness:          &liveness,
+		Spoof:             checkSpoof(firstFrame, faces[0]),
+	}
+	if !liveness.Passed {
+		match.Decision = DecisionLivenessFailed
+		match.MatchedTemplateId = ""
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "Liveness check failed",
+			Data: map[string]any{
+				"match": match,
+			},
+		}
+	}
+	if spoofRejected(match) {
+		return nil, spoofResponse(match)
+	}
+	if distance > threshold {
+		return nil, notMatchedResponse(match)
+	}
+
+	return s.matchedResponse(r, user, match, "liveness")
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"arkan-face-key/model"
+	"image"
+)
+
+// Machine-readable decision codes returned by the validation endpoints.
+const (
+	DecisionMatched        = "MATCHED"
+	DecisionNotMatched     = "NOT_MATCHED"
+	DecisionNoFace         = "NO_FACE"
+	DecisionMultipleFaces  = "MULTIPLE_FACES"
+	DecisionLivenessFailed = "LIVENESS_FAILED"
+	DecisionSpoofSuspected = "SPOOF_SUSPECTED"
+	DecisionLowQuality     = "LOW_QUALITY"
+)
+
+type FaceRectangle struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func NewFaceRectangle(r image.Rectangle) FaceRectangle {
+	return FaceRectangle{
+		X:      r.Min.X,
+		Y:      r.Min.Y,
+		Width:  r.Dx(),
+		Height: r.Dy(),
+	}
+}
+
+// MatchDetails explains how a verification decision was reached so clients
+// can guide the user and analysts can tune thresholds.
+type MatchDetails struct {
+	Decision          string                 `json:"decision"`
+	Distance          float32                `json:"distance"`
+	Threshold         float32                `json:"threshold"`
+	ThresholdPolicy   AppliedThreshold       `json:"threshold_policy"`
+	Metric            string                 `json:"metric"`
+	Aggregation       string                 `json:"aggregation"`
+	FaceRectangle     FaceRectangle          `json:"face_rectangle"`
+	FaceSelection     FaceSelectionResult    `json:"face_selection"`
+	MatchedTemplateId string                 `json:"matched_template_id,omitempty"`
+	TemplateCount     int                    `json:"template_count"`
+	Liveness          *LivenessResult        `json:"liveness,omitempty"`
+	Spoof             *model.FaceSpoofScores `json:"spoof,omitempty"`
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+
+	"github.com/Kagami/go-face"
+)
+
+// Quality checks of an enrollment image.
+const (
+	QualitySharpness  = "sharpness"
+	QualityBrightness = "brightness"
+	QualityContrast   = "contrast"
+	QualityFaceSize   = "face_size"
+	QualityYaw        = "yaw"
+	QualityRoll       = "roll"
+)
+
+// qualityGridSize is the side of the grayscale grid the face is resampled
+// to, so sharpness doesn't depend on the resolution of the camera.
+const qualityGridSize = 128
+
+// QualityCheck is a failed quality check, with a hint for the user.
+type QualityCheck struct {
+	Check   string  `json:"check"`
+	Value   float64 `json:"value"`
+	Limit   float64 `json:"limit"`
+	Message string  `json:"message"`
+}
+
+// QualityReport measures the face of an enrollment image:
+//   - sharpness: variance of the Laplacian of the face, low when blurry
+//   - brightness and contrast: mean and standard deviation of its luma, 0-255
+//   - face size: the shorter side of the face rectangle, in pixels
+//   - yaw: nose offset from the middle of the eyes, relative to their distance
+//   - roll: tilt of the line between the eyes, in degrees
+type QualityReport struct {
+	Sharpness  float64 `json:"sharpness"`
+	Brightness float64 `json:"brightness"`
+	Contrast   float64 `json:"contrast"`
+	FaceSize   int     `json:"face_size"`
+	FacePose
+	Passed bool           `json:"passed"`
+	Failed []QualityCheck `json:"failed"`
+}
+
+// FacePose is the head rotation estimated from the landmarks.
+type FacePose struct {
+	Yaw  float64 `json:"yaw"`
+	Roll float64 `json:"roll"`
+}
+
+// assessQuality measures the face in the image and checks it against the
+// QUALITY_* limits.
+func assessQuality(fileBytes []byte, f face.Face) (QualityReport, error) {
+	img, err := jpeg.Decode(bytes.NewReader(fileBytes))
+	if err != nil {
+		return QualityReport{}, err
+	}
+	return assessFaceQuality(img, f), nil
+}
+
+func assessFaceQuality(img image.Image, f face.Face) QualityReport {
+	region := f.Rectangle.Intersect(img.Bounds())
+	if region.Empty() {
+		region = img.Bounds()
+	}
+
+	report := QualityReport{
+		FaceSize: min(f.Rectangle.Dx(), f.Rectangle.Dy()),
+		Failed:   []QualityCheck{},
+	}
+	report.Sharpness, report.Brightness, report.Contrast = lumaStatistics(img, region)
+	report.FacePose = estimatePose(f)
+
+	fail := func(check string, value float64, limit float64, message string) {
+		report.Failed = append(report.Failed, QualityCheck{Check: check, Value: value, Limit: limit, Message: message})
+	}
+	if report.Sharpness < float64(config.QUALITY_MIN_SHARPNESS) {
+		fail(QualitySharpness, report.Sharpness, float64(config.QUALITY_MIN_SHARPNESS), "Image is blurry, hold the camera still and keep the face in focus")
+	}
+	if report.Brightness < float64(config.QUALITY_MIN_BRIGHTNESS) {
+		fail(QualityBrightness, report.Brightness, float64(config.QUALITY_MIN_BRIGHTNESS), "Face is too dark, move to a brighter place")
+	}
+	if report.Brightness > float64(config.QUALITY_MAX_BRIGHTNESS) {
+		fail(QualityBrightness, report.Brightness, float64(config.QUALITY_MAX_BRIGHTNESS), "Face is too bright, avoid direct light on the face")
+	}
+	if report.Contrast < float64(config.QUALITY_MIN_CONTRAST) {
+		fail(QualityContrast, report.Contrast, float64(config.QUALITY_MIN_CONTRAST), "Face has too little contrast, avoid backlight and haze")
+	}
+	if report.FaceSize < config.QUALITY_MIN_FACE_SIZE {
+		fail(QualityFaceSize, float64(report.FaceSize), float64(config.QUALITY_MIN_FACE_SIZE), "Face is too small, move closer to the camera")
+	}
+	if math.Abs(report.Yaw) > float64(config.QUALITY_MAX_YAW) {
+		fail(QualityYaw, report.Yaw, float64(config.QUALITY_MAX_YAW), "Face is turned aside, look straight at the camera")
+	}
+	if math.Abs(report.Roll) > float64(config.QUALITY_MAX_ROLL) {
+		fail(QualityRoll, report.Roll, float64(config.QUALITY_MAX_ROLL), "Head is tilted, keep it upright")
+	}
+	report.Passed = len(report.Failed) == 0
+	return report
+}
+
+// estimatePose is zero when the landmark model is unknown.
+func estimatePose(f face.Face) FacePose {
+	l, ok := newLandmarks(f)
+	if !ok {
+		return FacePose{}
+	}
+	return FacePose{Yaw: l.yaw(), Roll: l.roll()}
+}
+
+// lumaStatistics resamples the face into a grayscale grid and returns the
+// variance of its Laplacian, its mean and its standard deviation.
+func lumaStatistics(img image.Image, region image.Rectangle) (float64, float64, float64) {
+	n := min(qualityGridSize, region.Dx(), region.Dy())
+	if n < 3 {
+		return 0, 0, 0
+	}
+	cell := min(region.Dx(), region.Dy()) / n
+
+	grid := make([][]float64, n)
+	var sum, sumSquares float64
+	for y := range grid {
+		grid[y] = make([]float64, n)
+		for x := range grid[y] {
+			corner := region.Min.Add(image.Point{X: x * cell, Y: y * cell})
+			grid[y][x] = 255 * meanLuma(img, image.Rectangle{Min: corner, Max: corner.Add(image.Point{X: cell, Y: cell})})
+			sum += grid[y][x]
+			sumSquares += grid[y][x] * grid[y][x]
+		}
+	}
+	mean := sum / float64(n*n)
+	stdDev := math.Sqrt(math.Max(0, sumSquares/float64(n*n)-mean*mean))
+
+	// 4-neighbour Laplacian of the inner pixels
+	var lapSum, lapSquares float64
+	for y := 1; y < n-1; y++ {
+		for x := 1; x < n-1; x++ {
+			lap := grid[y-1][x] + grid[y+1][x] + grid[y][x-1] + grid[y][x+1] - 4*grid[y][x]
+			lapSum += lap
+			lapSquares += lap * lap
+		}
+	}
+	count := float64((n - 2) * (n - 2))
+	lapMean := lapSum / count
+	return lapSquares/count - lapMean*lapMean, mean, stdDev
+}
+
+// checkQuality rejects an enrollment image whose face is unfit to become a
+// template, nil when it passes or QUALITY_CHECK is off.
+func checkQuality(fileBytes []byte, f face.Face) (*QualityReport, *helper.Response) {
+	if !config.QUALITY_CHECK {
+		return nil, nil
+	}
+	report, err := assessQuality(fileBytes, f)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Error assessing image quality: %v", err),
+		}
+	}
+	if !report.Passed {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "Image quality is too low, please retake the photo",
+			Data: map[string]any{
+				"decision": DecisionLowQuality,
+				"quality":  report,
+			},
+		}
+	}
+	return &report, nil
+}
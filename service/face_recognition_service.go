@@ -2,67 +2,302 @@ package service
 
 import (
 	"arkan-face-key/config"
+	"arkan-face-key/dto"
 	"arkan-face-key/helper"
 	"arkan-face-key/model"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
-	"path/filepath"
-	"time"
 
 	"github.com/Kagami/go-face"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type FaceRecognitionService interface {
-	SaveUserFaceKey(r *gin.Context, image *multipart.FileHeader, username string) (*helper.Response, *helper.Response)
-	ValidateWithEmbedding(r *gin.Context, image *multipart.FileHeader, username string, threshold float32) (*helper.Response, *helper.Response)
-	ValidateWithImage(r *gin.Context, image *multipart.FileHeader, username string, threshold float32) (*helper.Response, *helper.Response)
+	SaveUserFaceKey(r *gin.Context, image *multipart.FileHeader, username string, selection dto.FaceSelection, idempotencyKey string) (*helper.Response, *helper.Response)
+	ValidateWithEmbedding(r *gin.Context, image *multipart.FileHeader, username string, options dto.FaceMatchOptions) (*helper.Response, *helper.Response)
+	ValidateWithImage(r *gin.Context, image *multipart.FileHeader, username string, options dto.FaceMatchOptions) (*helper.Response, *helper.Response)
+	IssueLivenessChallenge(r *gin.Context, username string) (*helper.Response, *helper.Response)
+	ValidateWithLiveness(r *gin.Context, frames []*multipart.FileHeader, username string, challengeId string, options dto.FaceMatchOptions) (*helper.Response, *helper.Response)
+	Identify(r *gin.Context, image *multipart.FileHeader, topK int, options dto.FaceMatchOptions) (*helper.Response, *helper.Response)
+	DetectFaces(r *gin.Context, image *multipart.FileHeader) (*helper.Response, *helper.Response)
+	CompareFaces(r *gin.Context, imageA *multipart.FileHeader, imageB *multipart.FileHeader, options dto.FaceMatchOptions) (*helper.Response, *helper.Response)
+	AddFaceTemplate(r *gin.Context, image *multipart.FileHeader, username string, source string, selection dto.FaceSelection) (*helper.Response, *helper.Response)
+	ListFaceTemplates(r *gin.Context, username string) (*helper.Response, *helper.Response)
+	RemoveFaceTemplate(r *gin.Context, username string, templateId string) (*helper.Response, *helper.Response)
+	GetFaceKeyStatus(r *gin.Context, username string) (*helper.Response, *helper.Response)
+	DeleteFaceKey(r *gin.Context, username string) (*helper.Response, *helper.Response)
+	ClearLockout(r *gin.Context, username string, deviceId string, ip string) (*helper.Response, *helper.Response)
 }
 
 type faceRecognitionService struct {
-	mongo       *mongo.Client
-	sftpService SftpService
+	users              mongoCollection
+	fileService        FileService
+	fileCleaner        FileCleaner
+	recognizerPools    RecognizerPools
+	faceIndex          FaceIndex
+	idempotencyStore   IdempotencyStore
+	auditLog           AuditLog
+	lockoutService     LockoutService
+	thresholdPolicy    ThresholdPolicy
+	verificationTokens VerificationTokenService
+	livenessService    LivenessService
+	faceDetector       FaceDetector
 }
 
-func NewFaceRecognitionService(mongo *mongo.Client, sftpService SftpService) FaceRecognitionService {
-	return &faceRecognitionService{mongo: mongo, sftpService: sftpService}
+func NewFaceRecognitionService(mongo *mongo.Client, fileService FileService, fileCleaner FileCleaner, recognizerPools RecognizerPools, faceIndex FaceIndex, idempotencyStore IdempotencyStore, auditLog AuditLog, lockoutService LockoutService, thresholdPolicy ThresholdPolicy, verificationTokens VerificationTokenService, livenessService LivenessService, faceDetector FaceDetector) FaceRecognitionService {
+	return &faceRecognitionService{
+		users:              userCollection(mongo),
+		fileService:        fileService,
+		fileCleaner:        fileCleaner,
+		recognizerPools:    recognizerPools,
+		faceIndex:          faceIndex,
+		idempotencyStore:   idempotencyStore,
+		auditLog:           auditLog,
+		lockoutService:     lockoutService,
+		thresholdPolicy:    thresholdPolicy,
+		verificationTokens: verificationTokens,
+		livenessService:    livenessService,
+		faceDetector:       faceDetector,
+	}
 }
 
-const dataDir = "faces"
+// acquireRecognizer waits for a free recognizer from pool. The caller must
+// hand it back with pool.Release.
+func (s *faceRecognitionService) acquireRecognizer(r *gin.Context, pool RecognizerPool) (*face.Recognizer, *helper.Response) {
+	ctx, cancel := context.WithTimeout(r.Request.Context(), config.RECOGNIZER_ACQUIRE_TIMEOUT)
+	defer cancel()
 
-func (s *faceRecognitionService) SaveUserFaceKey(r *gin.Context, image *multipart.FileHeader, username string) (*helper.Response, *helper.Response) {
-	// Validate username
-	if username == "" {
+	rec, err := pool.Acquire(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &helper.Response{
+				Status:  503,
+				Message: "Face recognizer is busy, please try again",
+			}
+		}
 		return nil, &helper.Response{
+			Status:  503,
+			Message: fmt.Sprintf("Face recognizer is unavailable: %v", err),
+		}
+	}
+	return rec, nil
+}
+
+// resolveMetric picks the distance metric of a request. When no metric is
+// requested and FACE_METRIC_COMPAT is on, legacyMetric keeps the numbers
+// existing clients were tuned against, and legacy is set.
+func resolveMetric(options dto.FaceMatchOptions, legacyMetric string) (metric DistanceMetric, legacy bool, errRes *helper.Response) {
+	name := options.Metric
+	if name == "" {
+		name = config.FACE_DISTANCE_METRIC
+		if config.FACE_METRIC_COMPAT {
+			name = legacyMetric
+			legacy = true
+		}
+	}
+
+	metric, err := GetDistanceMetric(name)
+	if err != nil {
+		return nil, false, &helper.Response{
 			Status:  400,
-			Message: "Invalid Username",
+			Message: err.Error(),
 		}
 	}
+	return metric, legacy, nil
+}
 
-	// Get user from database
-	var user model.User
-	collection := s.mongo.Database(config.MONGO_DB).Collection("user")
-	err := collection.FindOne(r, map[string]any{"username": username}).Decode(&user)
+// resolveThreshold applies the threshold policy, user is nil when the
+// request isn't about a known user.
+func (s *faceRecognitionService) resolveThreshold(r *gin.Context, user *model.User, metric DistanceMetric, legacy bool, options dto.FaceMatchOptions) (float32, AppliedThreshold, *helper.Response) {
+	threshold, applied, err := s.thresholdPolicy.Resolve(r, user, metric, legacy, options)
 	if err != nil {
-		return nil, &helper.Response{
-			Status:  404,
-			Message: fmt.Sprintf("User with username %s not found: %v", username, err),
+		return 0, applied, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error resolving threshold policy: %v", err),
 		}
 	}
+	return threshold, applied, nil
+}
+
+// revisionFilter matches the user only while its face key revision is
+// unchanged since it was read. Users enrolled before revisions existed have
+// no go_face_revision field yet.
+func revisionFilter(user model.User) map[string]any {
+	filter := map[string]any{
+		"username":         user.Username,
+		"go_face_revision": user.GoFaceRevision,
+	}
+	if user.GoFaceRevision == 0 {
+		filter["go_face_revision"] = map[string]any{"$in": []any{0, nil}}
+	}
+	return filter
+}
 
-	// Initialize the face recognizer
-	rec, err := face.NewRecognizer(dataDir)
+// checkLockout answers 423 when one of keys is locked out. A lockout store
+// failure is logged and lets the verification through.
+func (s *faceRecognitionService) checkLockout(r *gin.Context, keys []string) *helper.Response {
+	retryAfter, err := s.lockoutService.Check(r, keys)
 	if err != nil {
+		log.Printf("Error checking lockout of %v: %v", keys, err)
+		return nil
+	}
+	if retryAfter > 0 {
+		return lockedOutResponse(r, retryAfter)
+	}
+	return nil
+}
+
+// recordLockout counts a non-matching face, a failed liveness check or a
+// suspected spoof as a failed attempt; any other
+// rejection (no face, bad image, ...) doesn't count.
+func (s *faceRecognitionService) recordLockout(r *gin.Context, keys []string, res *helper.Response, errRes *helper.Response) {
+	if res != nil {
+		s.lockoutService.RecordSuccess(r, keys)
+		return
+	}
+	if data, ok := errRes.Data.(map[string]any); ok {
+		if match, ok := data["match"].(MatchDetails); ok && isFailedAttempt(match.Decision) {
+			s.lockoutService.RecordFailure(r, keys)
+		}
+	}
+}
+
+func isFailedAttempt(decision string) bool {
+	return decision == DecisionNotMatched || decision == DecisionLivenessFailed || decision == DecisionSpoofSuspected
+}
+
+// checkSpoof scores the probe image for presentation attacks, nil when
+// SPOOF_POLICY is off.
+func checkSpoof(fileBytes []byte, probe face.Face) *model.FaceSpoofScores {
+	if config.SPOOF_POLICY == SpoofPolicyOff {
+		return nil
+	}
+	scores, err := analyzeSpoof(fileBytes, probe.Rectangle)
+	if err != nil {
+		log.Printf("Error analyzing image for spoofing: %v", err)
+		return nil
+	}
+	if scores.Suspected {
+		log.Printf("Presentation attack suspected, policy %s: %+v", config.SPOOF_POLICY, scores)
+	}
+	return &scores
+}
+
+// spoofRejected reports whether the policy rejects match for spoofing.
+func spoofRejected(match MatchDetails) bool {
+	return match.Spoof != nil && match.Spoof.Suspected && config.SPOOF_POLICY == SpoofPolicyReject
+}
+
+// spoofResponse rejects a verification suspected to be a presentation
+// attack.
+func spoofResponse(match MatchDetails) *helper.Response {
+	match.Decision = DecisionSpoofSuspected
+	match.MatchedTemplateId = ""
+	return &helper.Response{
+		Status:  400,
+		Message: "Presentation attack suspected",
+		Data: map[string]any{
+			"match": match,
+		},
+	}
+}
+
+// templateDistances compares descriptor with the stored embedding of every
+// template.
+func templateDistances(templates []model.FaceTemplate, descriptor face.Descriptor, metric DistanceMetric) ([]float32, *helper.Response) {
+	distances := make([]float32, len(templates))
+	for i, template := range templates {
+		// Convert template embedding (JSON string) to face.Descriptor
+		templateDescriptor, err := helper.StringToDescriptor(template.Embedding)
+		if err != nil {
+			return nil, &helper.Response{
+				Status:  500,
+				Message: fmt.Sprintf("Error converting embedding string to descriptor: %v", err),
+			}
+		}
+		distances[i] = metric.Distance(descriptor, templateDescriptor)
+	}
+	return distances, nil
+}
+
+// notMatchedResponse rejects a verification whose distance is over the
+// threshold.
+func notMatchedResponse(match MatchDetails) *helper.Response {
+	match.Decision = DecisionNotMatched
+	match.MatchedTemplateId = ""
+	return &helper.Response{
+		Status:  400,
+		Message: "Face not matched",
+		Data: map[string]any{
+			"match": match,
+		},
+	}
+}
+
+// matchedResponse answers a successful verification with a token
+// downstream services can check instead of trusting the app, unless
+// verification tokens are disabled.
+func (s *faceRecognitionService) matchedResponse(r *gin.Context, user model.User, match MatchDetails, method string) (*helper.Response, *helper.Response) {
+	data := map[string]any{
+		"user_id":            user.Id,
+		"username":           user.Username,
+		"full_name":          user.FullName,
+		"face_key_file":      user.GoFaceImageUrl,
+		"face_key_embedding": user.GoFaceEmbedding,
+		"match":              match,
+	}
+
+	token, expiresAt, err := s.verificationTokens.Issue(r, VerificationClaims{
+		Subject:   user.Username,
+		UserId:    user.Id,
+		Method:    method,
+		Distance:  match.Distance,
+		Threshold: match.Threshold,
+		Metric:    match.Metric,
+	})
+	switch {
+	case err == nil:
+		data["verification_token"] = token
+		data["verification_token_expires_at"] = expiresAt
+	case !errors.Is(err, ErrVerificationTokensDisabled):
 		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Can't init face recognizer: %v", err),
+			Status:  500,
+			Message: fmt.Sprintf("Error issuing verification token: %v", err),
 		}
 	}
-	defer rec.Close()
 
-	// Open the uploaded image file
+	return &helper.Response{
+		Status:  200,
+		Message: "Face matched",
+		Data:    data,
+	}, nil
+}
+
+// findUser loads a user document by username.
+func (s *faceRecognitionService) findUser(r *gin.Context, username string) (model.User, *helper.Response) {
+	var user model.User
+	collection := s.users
+	err := collection.FindOne(r, map[string]any{"username": username}).Decode(&user)
+	if err != nil {
+		return user, &helper.Response{
+			Status:  404,
+			Message: fmt.Sprintf("User with username %s not found: %v", username, err),
+		}
+	}
+	return user, nil
+}
+
+// readImage reads the uploaded image into memory and preprocesses it into
+// an upright JPEG.
+func readImage(image *multipart.FileHeader) ([]byte, *helper.Response) {
 	file, err := image.Open()
 	if err != nil {
 		return nil, &helper.Response{
@@ -72,54 +307,139 @@ func (s *faceRecognitionService) SaveUserFaceKey(r *gin.Context, image *multipar
 	}
 	defer file.Close()
 
-	// Read the uploaded file into a byte slice
 	fileBytes, err := io.ReadAll(file)
 	if err != nil {
 		return nil, &helper.Response{
 			Status:  400,
-			Message: fmt.Sprintf("Error reading file byte uploaded image: %v", err),
+			Message: fmt.Sprintf("Error reading uploaded image: %v", err),
 		}
 	}
 
-	// Recognize faces in the uploaded image
-	refFace, err := rec.Recognize(fileBytes)
+	fileBytes, err = preprocessImage(fileBytes)
 	if err != nil {
 		return nil, &helper.Response{
 			Status:  400,
-			Message: fmt.Sprintf("Error recognizing face in uploaded image: %v", err),
+			Message: fmt.Sprintf("Error processing uploaded image: %v", err),
 		}
 	}
+	return fileBytes, nil
+}
 
-	// Check if any faces were found
-	if len(refFace) == 0 {
+// SaveUserFaceKey enrolls the primary face key. A non-empty idempotencyKey
+// makes retries of a successful request replay its response, as long as
+// they send the same image and face selection.
+func (s *faceRecognitionService) SaveUserFaceKey(r *gin.Context, image *multipart.FileHeader, username string, selection dto.FaceSelection, idempotencyKey string) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "enroll", username, res, errRes) }()
+
+	if idempotencyKey == "" {
+		return s.saveUserFaceKey(r, image, username, selection)
+	}
+
+	requestHash, errRes := saveRequestHash(image, selection)
+	if errRes != nil {
+		return nil, errRes
+	}
+	key := "save:" + username + ":" + idempotencyKey
+	stored, err := s.idempotencyStore.Begin(r, key, requestHash)
+	if errors.Is(err, ErrIdempotencyInProgress) {
+		return nil, &helper.Response{
+			Status:  409,
+			Message: err.Error(),
+		}
+	}
+	if errors.Is(err, ErrIdempotencyMismatch) {
+		return nil, &helper.Response{
+			Status:  422,
+			Message: err.Error(),
+		}
+	}
+	if err != nil {
 		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error checking Idempotency-Key: %v", err),
+		}
+	}
+	if stored != nil {
+		r.Header("Idempotency-Replayed", "true")
+		return stored, nil
+	}
+
+	res, errRes = s.saveUserFaceKey(r, image, username, selection)
+	if errRes != nil {
+		s.idempotencyStore.Abort(r, key)
+		return nil, errRes
+	}
+	if err := s.idempotencyStore.Complete(r, key, res); err != nil {
+		log.Printf("Error storing response for Idempotency-Key %s: %v", key, err)
+	}
+	return res, nil
+}
+
+// saveRequestHash identifies a save request by its uploaded image, as sent
+// before preprocessing, and its face selection.
+func saveRequestHash(image *multipart.FileHeader, selection dto.FaceSelection) (string, *helper.Response) {
+	file, err := image.Open()
+	if err != nil {
+		return "", &helper.Response{
 			Status:  400,
-			Message: "No faces found in the image",
+			Message: fmt.Sprintf("Error opening uploaded image: %v", err),
 		}
 	}
+	defer file.Close()
 
-	// Check if multiple faces were found
-	if len(refFace) > 1 {
-		return nil, &helper.Response{
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", &helper.Response{
 			Status:  400,
-			Message: "Multiple faces found in the image",
+			Message: fmt.Sprintf("Error reading uploaded image: %v", err),
 		}
 	}
+	fmt.Fprintf(hash, "\n%s\n%d", selection.Mode, selection.Index)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	// Extract descriptors (embeddings)
-	embedding := refFace[0].Descriptor
-	faceKeyFileName := fmt.Sprintf("%s_%d_face_key.jpeg", user.Username, time.Now().Unix())
-	// Upload the file to SFTP
-	// Upload the file to SFTP
-	_, errRes := s.sftpService.UploadFile(image, faceKeyFileName)
-	if errRes != nil {
+func (s *faceRecognitionService) saveUserFaceKey(r *gin.Context, image *multipart.FileHeader, username string, selection dto.FaceSelection) (*helper.Response, *helper.Response) {
+	// Validate username
+	if username == "" {
 		return nil, &helper.Response{
-			Status:  errRes.Status,
-			Message: fmt.Sprintf("Error uploading face key file: %v", errRes.Message),
+			Status:  400,
+			Message: "Invalid Username",
 		}
 	}
 
-	// Convert embedding to string for storage
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+	collection := s.users
+
+	// Borrow a face recognizer configured for enrollment from the pool
+	pool := s.recognizerPools.Enroll
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
+	}
+	defer pool.Release(rec)
+
+	// Read the uploaded image and recognize the face in it
+	fileBytes, errRes := readImage(image)
+	if errRes != nil {
+		return nil, errRes
+	}
+	refFace, faceSelection, errRes := s.detectFace(rec, fileBytes, selection)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Refuse faces that would make a poor template
+	quality, errRes := checkQuality(fileBytes, refFace)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Extract descriptors (embeddings) and convert them to string for storage
+	embedding := refFace.Descriptor
 	embeddingStr, err := helper.DescriptorToString(embedding)
 	if err != nil {
 		return nil, &helper.Response{
@@ -128,28 +448,35 @@ func (s *faceRecognitionService) SaveUserFaceKey(r *gin.Context, image *multipar
 		}
 	}
 
-	// Delete old face key file if it exists
-	if user.GoFaceImageUrl != "" {
-		_, errRes := s.sftpService.DeleteFile(user.GoFaceImageUrl)
-		if errRes != nil {
-			return nil, &helper.Response{
-				Status:  errRes.Status,
-				Message: fmt.Sprintf("Error deleting old face key file: %v", errRes.Message),
-			}
+	// 1. Upload the new file to storage, nothing references it yet. The
+	// name is unique per attempt, so a concurrent save that loses the
+	// revision check can't overwrite the file of the one that wins.
+	faceKeyFileName := fmt.Sprintf("%s_%s_face_key.jpeg", user.Username, primitive.NewObjectID().Hex())
+	_, errRes = s.fileService.UploadBytes(fileBytes, faceKeyFileName)
+	if errRes != nil {
+		return nil, &helper.Response{
+			Status:  errRes.Status,
+			Message: fmt.Sprintf("Error uploading face key file: %v", errRes.Message),
 		}
 	}
 
-	//save to database
+	// 2. Point the user at the new file, only if the face key revision is
+	// still the one we read. The recognizer parameters record how the
+	// embedding was produced.
+	recognizerParams := pool.Params()
 	update := map[string]any{
-		"go_face_image_url": faceKeyFileName,
-		"go_face_embedding": embeddingStr,
-	}
-	_, err = collection.UpdateOne(
-		r,
-		map[string]any{"username": user.Username},
-		map[string]any{"$set": update},
-	)
+		"go_face_image_url":  faceKeyFileName,
+		"go_face_embedding":  embeddingStr,
+		"go_face_recognizer": recognizerParams,
+	}
+	result, err := collection.UpdateOne(r, revisionFilter(user), map[string]any{
+		"$set": update,
+		"$inc": map[string]any{"go_face_revision": 1},
+	})
 	if err != nil {
+		// The write may have been applied despite the error, the cleaner
+		// keeps the file if the user references it
+		s.fileCleaner.Schedule(r, faceKeyFileName, "enrollment failed")
 		return nil, &helper.Response{
 			Status:  500,
 			Message: "Error saving user embedding",
@@ -158,6 +485,25 @@ func (s *faceRecognitionService) SaveUserFaceKey(r *gin.Context, image *multipar
 			},
 		}
 	}
+	if result.MatchedCount == 0 {
+		s.fileCleaner.Schedule(r, faceKeyFileName, "enrollment conflict")
+		return nil, &helper.Response{
+			Status:  409,
+			Message: "Face key was changed by another request, please try again",
+		}
+	}
+
+	// 3. The old file is no longer referenced, delete it in the background
+	if user.GoFaceImageUrl != "" {
+		s.fileCleaner.Schedule(r, user.GoFaceImageUrl, "replaced face key")
+	}
+
+	// Keep the identification index in sync with the new enrollment
+	user.GoFaceImageUrl = faceKeyFileName
+	user.GoFaceEmbedding = embeddingStr
+	user.GoFaceRecognizer = &recognizerParams
+	user.GoFaceRevision++
+	s.faceIndex.Upsert(user)
 
 	return &helper.Response{
 		Status:  200,
@@ -166,11 +512,17 @@ func (s *faceRecognitionService) SaveUserFaceKey(r *gin.Context, image *multipar
 			"user_id":            user.Id,
 			"face_key_file":      faceKeyFileName,
 			"face_key_embedding": embeddingStr,
+			"revision":           user.GoFaceRevision,
+			"recognizer":         recognizerParams,
+			"quality":            quality,
+			"face_selection":     faceSelection,
 		},
 	}, nil
 }
 
-func (s *faceRecognitionService) ValidateWithEmbedding(r *gin.Context, image *multipart.FileHeader, username string, threshold float32) (*helper.Response, *helper.Response) {
+func (s *faceRecognitionService) ValidateWithEmbedding(r *gin.Context, image *multipart.FileHeader, username string, options dto.FaceMatchOptions) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "validate_embedding", username, res, errRes) }()
+
 	// Validate username
 	if username == "" {
 		return nil, &helper.Response{
@@ -179,107 +531,92 @@ func (s *faceRecognitionService) ValidateWithEmbedding(r *gin.Context, image *mu
 		}
 	}
 
-	// Get user from database
-	var user model.User
-	collection := s.mongo.Database(config.MONGO_DB).Collection("user")
-	err := collection.FindOne(r, map[string]any{"username": username}).Decode(&user)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  404,
-			Message: fmt.Sprintf("User with username %s not found: %v", username, err),
-		}
+	// Refuse verification while the user or device is locked out
+	lockoutKeys := LockoutKeys(r, username)
+	if errRes := s.checkLockout(r, lockoutKeys); errRes != nil {
+		return nil, errRes
 	}
+	defer func() { s.recordLockout(r, lockoutKeys, res, errRes) }()
 
-	// Check if user has a face key embedding
-	rec, err := face.NewRecognizer(dataDir)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Can't init face recognizer: %v", err),
-		}
+	// Resolve the distance metric
+	metric, legacy, errRes := resolveMetric(options, MetricHalfSquaredEuclidean)
+	if errRes != nil {
+		return nil, errRes
 	}
-	defer rec.Close()
 
-	// Check if user has a face key file
-	file, err := image.Open()
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Error opening uploaded image: %v", err),
-		}
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
 	}
-	defer file.Close()
 
-	// Read the uploaded file into a byte slice
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Error reading uploaded image: %v", err),
-		}
+	// Apply the threshold policy of the user
+	threshold, thresholdPolicy, errRes := s.resolveThreshold(r, &user, metric, legacy, options)
+	if errRes != nil {
+		return nil, errRes
 	}
 
-	// Recognize faces in the uploaded image
-	refFace, err := rec.Recognize(fileBytes)
-	if err != nil {
+	// Check if user has any enrolled face template
+	templates := user.FaceTemplates()
+	if len(templates) == 0 {
 		return nil, &helper.Response{
 			Status:  400,
-			Message: fmt.Sprintf("Error recognizing face in uploaded image: %v", err),
+			Message: "User does not have a face key",
 		}
 	}
 
-	// Check if any faces were found
-	if len(refFace) == 0 {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "No faces found",
-		}
+	// Borrow a face recognizer configured for verification from the pool
+	pool := s.recognizerPools.Verify
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
 	}
+	defer pool.Release(rec)
 
-	// Check if multiple faces were found
-	if len(refFace) > 1 {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "Multiple faces found",
-		}
+	// Read the uploaded image and recognize the face in it
+	fileBytes, errRes := readImage(image)
+	if errRes != nil {
+		return nil, errRes
 	}
-
-	// Extract descriptors (embeddings)
-	desc1 := refFace[0].Descriptor
-	// Convert user.FaceKeyEmbedding (JSON string) to face.Descriptor
-	desc2, err := helper.StringToDescriptor(user.GoFaceEmbedding)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  500,
-			Message: fmt.Sprintf("Error converting embedding string to descriptor: %v", err),
-		}
+	probe, faceSelection, errRes := s.detectFace(rec, fileBytes, options.Selection)
+	if errRes != nil {
+		return nil, errRes
 	}
 
-	// Compute Euclidean distance
-	distance := euclideanDistance(desc1, desc2)
-
-	// Check if the distance is below the threshold
+	// Compute the distance to every stored template embedding
+	distances, errRes := templateDistances(templates, probe.Descriptor, metric)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Check if the aggregated distance is below the threshold
+	distance, best := aggregateDistances(distances, config.FACE_TEMPLATE_AGGREGATION)
+	match := MatchDetails{
+		Decision:          DecisionMatched,
+		Distance:          distance,
+		Threshold:         threshold,
+		ThresholdPolicy:   thresholdPolicy,
+		Metric:            metric.Name(),
+		Aggregation:       config.FACE_TEMPLATE_AGGREGATION,
+		FaceRectangle:     NewFaceRectangle(probe.Rectangle),
+		FaceSelection:     faceSelection,
+		MatchedTemplateId: templates[best].Id,
+		TemplateCount:     len(templates),
+		Spoof:             checkSpoof(fileBytes, probe),
+	}
+	if spoofRejected(match) {
+		return nil, spoofResponse(match)
+	}
 	if distance > threshold {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "Face not matched",
-		}
+		return nil, notMatchedResponse(match)
 	}
 
-	return &helper.Response{
-		Status:  200,
-		Message: "Face matched",
-		Data: map[string]any{
-			"user_id":            user.Id,
-			"username":           user.Username,
-			"full_name":          user.FullName,
-			"face_key_file":      user.GoFaceImageUrl,
-			"face_key_embedding": user.GoFaceEmbedding,
-		},
-	}, nil
+	return s.matchedResponse(r, user, match, "embedding")
 }
 
-func (s *faceRecognitionService) ValidateWithImage(r *gin.Context, image *multipart.FileHeader, username string, threshold float32) (*helper.Response, *helper.Response) {
+func (s *faceRecognitionService) ValidateWithImage(r *gin.Context, image *multipart.FileHeader, username string, options dto.FaceMatchOptions) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "validate_image", username, res, errRes) }()
+
 	// Validate username
 	if username == "" {
 		return nil, &helper.Response{
@@ -288,148 +625,199 @@ func (s *faceRecognitionService) ValidateWithImage(r *gin.Context, image *multip
 		}
 	}
 
+	// Refuse verification while the user or device is locked out
+	lockoutKeys := LockoutKeys(r, username)
+	if errRes := s.checkLockout(r, lockoutKeys); errRes != nil {
+		return nil, errRes
+	}
+	defer func() { s.recordLockout(r, lockoutKeys, res, errRes) }()
+
+	// Resolve the distance metric, ClassifyThreshold used to compare squared
+	// Euclidean distances here
+	metric, legacy, errRes := resolveMetric(options, MetricSquaredEuclidean)
+	if errRes != nil {
+		return nil, errRes
+	}
+
 	// Get user from database
-	var user model.User
-	collection := s.mongo.Database(config.MONGO_DB).Collection("user")
-	err := collection.FindOne(r, map[string]any{"username": username}).Decode(&user)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  404,
-			Message: fmt.Sprintf("User with username %s not found: %v", username, err),
-		}
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
 	}
 
-	// Initialize the face recognizer
-	rec, err := face.NewRecognizer(dataDir)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Can't init face recognizer: %v", err),
+	// Apply the threshold policy of the user
+	threshold, thresholdPolicy, errRes := s.resolveThreshold(r, &user, metric, legacy, options)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Only templates with a stored image can be compared image to image
+	var templates []model.FaceTemplate
+	for _, template := range user.FaceTemplates() {
+		if template.ImageUrl != "" {
+			templates = append(templates, template)
 		}
 	}
-	defer rec.Close()
 
 	// Check if user has a face key file
-	if user.GoFaceImageUrl == "" {
+	if len(templates) == 0 {
 		return nil, &helper.Response{
 			Status:  400,
 			Message: "User does not have a face key image",
 		}
 	}
 
-	// Load the base image for the user
-	baseImage := filepath.Join(dataDir, "images/"+user.GoFaceImageUrl)
-	baseFaces, err := rec.RecognizeFile(baseImage)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Error recognizing face in base image: %v", err),
-		}
+	// Borrow a face recognizer configured for verification from the pool
+	pool := s.recognizerPools.Verify
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
 	}
+	defer pool.Release(rec)
 
-	// Check if any faces were found in the base image
-	if len(baseFaces) == 0 {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "No faces found",
+	// Load the base images of the user from the storage they were uploaded to
+	baseDescriptors := make([]face.Descriptor, len(templates))
+	for i, template := range templates {
+		baseImage, errRes := s.fileService.ReadFile(template.ImageUrl)
+		if errRes != nil {
+			return nil, &helper.Response{
+				Status:  errRes.Status,
+				Message: fmt.Sprintf("Error reading base image: %v", errRes.Message),
+			}
+		}
+		// Older face keys were stored as uploaded
+		baseImage, err := preprocessImage(baseImage)
+		if err != nil {
+			return nil, &helper.Response{
+				Status:  400,
+				Message: fmt.Sprintf("Error processing base image: %v", err),
+			}
+		}
+		baseFaces, _, err := s.faceDetector.Detect(rec, baseImage)
+		if err != nil {
+			return nil, &helper.Response{
+				Status:  400,
+				Message: fmt.Sprintf("Error recognizing face in base image: %v", err),
+			}
 		}
-	}
 
-	// Check if multiple faces were found in the base image
-	if len(baseFaces) > 1 {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "Multiple faces found in the base image",
+		// Check if a face was found in the base image
+		if len(baseFaces) == 0 {
+			return nil, &helper.Response{
+				Status:  400,
+				Message: "No faces found in the base image",
+			}
+		}
+		baseDescriptors[i] = baseFaces[0].Descriptor
+
+		// A face selection may have enrolled one of several faces, it is the
+		// one closest to the stored embedding
+		if len(baseFaces) > 1 {
+			enrolled, err := helper.StringToDescriptor(template.Embedding)
+			if err != nil {
+				return nil, &helper.Response{
+					Status:  400,
+					Message: "Multiple faces found in the base image",
+				}
+			}
+			for _, f := range baseFaces[1:] {
+				if euclideanDistance(f.Descriptor, enrolled) < euclideanDistance(baseDescriptors[i], enrolled) {
+					baseDescriptors[i] = f.Descriptor
+				}
+			}
 		}
 	}
 
-	// Use the first face found in the base image
-	baseFace := baseFaces[0]
+	// Read the uploaded image and recognize the face in it
+	fileBytes, errRes := readImage(image)
+	if errRes != nil {
+		return nil, errRes
+	}
+	probe, faceSelection, errRes := s.detectFace(rec, fileBytes, options.Selection)
+	if errRes != nil {
+		return nil, errRes
+	}
 
-	// Prepare the recognizer with the base face descriptor
-	var samples []face.Descriptor
-	var sampleIndexes []int32
+	// Compare with every base face
+	distances := make([]float32, len(baseDescriptors))
+	for i, descriptor := range baseDescriptors {
+		distances[i] = metric.Distance(probe.Descriptor, descriptor)
+	}
 
-	// Add the base face descriptor to the recognizer
-	samples = append(samples, baseFace.Descriptor)
-	sampleIndexes = append(sampleIndexes, int32(0))
+	distance, best := aggregateDistances(distances, config.FACE_TEMPLATE_AGGREGATION)
+	match := MatchDetails{
+		Decision:          DecisionMatched,
+		Distance:          distance,
+		Threshold:         threshold,
+		ThresholdPolicy:   thresholdPolicy,
+		Metric:            metric.Name(),
+		Aggregation:       config.FACE_TEMPLATE_AGGREGATION,
+		FaceRectangle:     NewFaceRectangle(probe.Rectangle),
+		FaceSelection:     faceSelection,
+		MatchedTemplateId: templates[best].Id,
+		TemplateCount:     len(templates),
+		Spoof:             checkSpoof(fileBytes, probe),
+	}
+	if spoofRejected(match) {
+		return nil, spoofResponse(match)
+	}
+	if distance > threshold {
+		return nil, notMatchedResponse(match)
+	}
 
-	// Set the samples and their indexes in the recognizer
-	rec.SetSamples(samples, sampleIndexes)
+	return s.matchedResponse(r, user, match, "image")
+}
 
-	// Open the uploaded image file
-	file, err := image.Open()
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Error opening uploaded image: %v", err),
-		}
-	}
-	defer file.Close()
+func (s *faceRecognitionService) Identify(r *gin.Context, image *multipart.FileHeader, topK int, options dto.FaceMatchOptions) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "identify", "", res, errRes) }()
 
-	// Read the uploaded file into a byte slice
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Error reading uploaded image: %v", err),
-		}
+	// Resolve the metric and the default threshold policy
+	metric, legacy, errRes := resolveMetric(options, MetricHalfSquaredEuclidean)
+	if errRes != nil {
+		return nil, errRes
 	}
-
-	// Recognize faces in the uploaded image
-	faces, err := rec.Recognize(fileBytes)
-	if err != nil {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: fmt.Sprintf("Error recognizing face in uploaded image: %v", err),
-		}
+	threshold, thresholdPolicy, errRes := s.resolveThreshold(r, nil, metric, legacy, options)
+	if errRes != nil {
+		return nil, errRes
 	}
 
-	// Check if any faces were found in the uploaded image
-	if len(faces) == 0 {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "No faces found",
-		}
+	// Borrow a face recognizer configured for verification from the pool
+	pool := s.recognizerPools.Verify
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
 	}
+	defer pool.Release(rec)
 
-	// Check if multiple faces were found in the uploaded image
-	if len(faces) > 1 {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "Multiple faces found in the uploaded image",
-		}
+	// Read the uploaded image and recognize the face in it
+	fileBytes, errRes := readImage(image)
+	if errRes != nil {
+		return nil, errRes
+	}
+	probe, faceSelection, errRes := s.detectFace(rec, fileBytes, options.Selection)
+	if errRes != nil {
+		return nil, errRes
 	}
 
-	// Classify the face in the uploaded image
-	faceIndex := rec.ClassifyThreshold(faces[0].Descriptor, threshold)
-	if faceIndex < 0 {
-		return nil, &helper.Response{
-			Status:  400,
-			Message: "Face not matched",
-		}
+	// Rank enrolled users by distance to the uploaded face
+	candidates := s.faceIndex.Search(probe.Descriptor, metric, topK, threshold)
+
+	message := "Face identified"
+	if len(candidates) == 0 {
+		message = "No matching face found"
 	}
 
-	// Check if the recognized face matches the user's face
 	return &helper.Response{
 		Status:  200,
-		Message: "Face matched",
+		Message: message,
 		Data: map[string]any{
-			"user_id":            user.Id,
-			"username":           user.Username,
-			"full_name":          user.FullName,
-			"face_key_file":      user.GoFaceImageUrl,
-			"face_key_embedding": user.GoFaceEmbedding,
+			"candidates":       candidates,
+			"top_k":            topK,
+			"threshold":        threshold,
+			"threshold_policy": thresholdPolicy,
+			"metric":           metric.Name(),
+			"indexed_users":    s.faceIndex.Len(),
+			"face_selection":   faceSelection,
 		},
 	}, nil
 }
-
-// euclideanDistance calculates the Euclidean distance between two face descriptors.
-func euclideanDistance(a, b face.Descriptor) float32 {
-	var sum float32
-	for i := range a {
-		diff := a[i] - b[i]
-		sum += diff * diff
-	}
-	return float32((sum) * 0.5) // Remove *0.5 if you want the actual Euclidean distance (sqrt(sum))
-}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"arkan-face-key/helper"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"sort"
+
+	"github.com/Kagami/go-face"
+)
+
+// Face selection modes, for images with more than one face.
+const (
+	FaceSelectionReject      = "reject"
+	FaceSelectionLargest     = "largest"
+	FaceSelectionMostCentral = "most_central"
+	FaceSelectionIndex       = "index"
+)
+
+var faceSelectionModes = []string{FaceSelectionReject, FaceSelectionLargest, FaceSelectionMostCentral, FaceSelectionIndex}
+
+// FaceSelectionResult reports which face of the image was used.
+type FaceSelectionResult struct {
+	Mode          string        `json:"mode"`
+	FaceCount     int           `json:"face_count"`
+	IgnoredFaces  int           `json:"ignored_faces"`
+	SelectedIndex int           `json:"selected_index"`
+	FaceRectangle FaceRectangle `json:"face_rectangle"`
+	Detector      string        `json:"detector"`
+}
+
+// detectFace recognizes the image and picks the face to use with the
+// selection mode, FACE_SELECTION when the request has none. Faces are
+// numbered left to right, as listed in the face_rectangles of a rejection.
+func (s *faceRecognitionService) detectFace(rec *face.Recognizer, fileBytes []byte, selection dto.FaceSelection) (face.Face, FaceSelectionResult, *helper.Response) {
+	mode := selection.Mode
+	if mode == "" {
+		mode = config.FACE_SELECTION
+	}
+	if !isFaceSelectionMode(mode) {
+		return face.Face{}, FaceSelectionResult{}, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Unknown face selection %q, expected one of %v", mode, faceSelectionModes),
+		}
+	}
+
+	faces, detector, err := s.faceDetector.Detect(rec, fileBytes)
+	if err != nil {
+		return face.Face{}, FaceSelectionResult{}, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Error recognizing face in uploaded image: %v", err),
+		}
+	}
+
+	// Check if any faces were found
+	if len(faces) == 0 {
+		return face.Face{}, FaceSelectionResult{}, &helper.Response{
+			Status:  400,
+			Message: "No faces found in the image",
+			Data: map[string]any{
+				"decision":   DecisionNoFace,
+				"face_count": 0,
+			},
+		}
+	}
+
+	sortFaces(faces)
+	rectangles := make([]FaceRectangle, len(faces))
+	for i, f := range faces {
+		rectangles[i] = NewFaceRectangle(f.Rectangle)
+	}
+
+	selected := 0
+	switch {
+	case mode == FaceSelectionIndex:
+		if selection.Index < 0 || selection.Index >= len(faces) {
+			return face.Face{}, FaceSelectionResult{}, &helper.Response{
+				Status:  400,
+				Message: fmt.Sprintf("Face index %d is out of range, %d faces found in the image", selection.Index, len(faces)),
+				Data: map[string]any{
+					"face_count":      len(faces),
+					"face_rectangles": rectangles,
+				},
+			}
+		}
+		selected = selection.Index
+	case len(faces) == 1:
+	case mode == FaceSelectionReject:
+		return face.Face{}, FaceSelectionResult{}, &helper.Response{
+			Status:  400,
+			Message: "Multiple faces found in the image",
+			Data: map[string]any{
+				"decision":        DecisionMultipleFaces,
+				"face_count":      len(faces),
+				"face_rectangles": rectangles,
+			},
+		}
+	case mode == FaceSelectionLargest:
+		selected = largestFace(faces)
+	case mode == FaceSelectionMostCentral:
+		size, err := jpeg.DecodeConfig(bytes.NewReader(fileBytes))
+		if err != nil {
+			return face.Face{}, FaceSelectionResult{}, &helper.Response{
+				Status:  400,
+				Message: fmt.Sprintf("Error reading image size: %v", err),
+			}
+		}
+		selected = mostCentralFace(faces, image.Point{X: size.Width / 2, Y: size.Height / 2})
+	}
+
+	return faces[selected], FaceSelectionResult{
+		Mode:          mode,
+		FaceCount:     len(faces),
+		IgnoredFaces:  len(faces) - 1,
+		SelectedIndex: selected,
+		FaceRectangle: rectangles[selected],
+		Detector:      detector,
+	}, nil
+}
+
+// sortFaces numbers faces left to right, top to bottom for equal lefts.
+func sortFaces(faces []face.Face) {
+	sort.SliceStable(faces, func(i, j int) bool {
+		a, b := faces[i].Rectangle.Min, faces[j].Rectangle.Min
+		return a.X < b.X || (a.X == b.X && a.Y < b.Y)
+	})
+}
+
+func isFaceSelectionMode(mode string) bool {
+	for _, m := range faceSelectionModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func largestFace(faces []face.Face) int {
+	best := 0
+	for i, f := range faces {
+		if area(f.Rectangle) > area(faces[best].Rectangle) {
+			best = i
+		}
+	}
+	return best
+}
+
+// mostCentralFace picks the face whose center is closest to the center of
+// the image.
+func mostCentralFace(faces []face.Face, center image.Point) int {
+	best, bestDistance := 0, -1.0
+	for i, f := range faces {
+		rect := f.Rectangle
+		distance := pointDistance(midpoint(rect.Min, rect.Max), center)
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return best
+}
+
+func area(rect image.Rectangle) int {
+	return rect.Dx() * rect.Dy()
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"fmt"
+	"mime/multipart"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *faceRecognitionService) AddFaceTemplate(r *gin.Context, image *multipart.FileHeader, username string, source string, selection dto.FaceSelection) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "add_template", username, res, errRes) }()
+
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Check the template limit before doing any recognition work
+	if len(user.FaceTemplates()) >= config.FACE_MAX_TEMPLATES {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("User already has the maximum of %d face templates", config.FACE_MAX_TEMPLATES),
+		}
+	}
+
+	// Borrow a face recognizer configured for enrollment from the pool
+	pool := s.recognizerPools.Enroll
+	rec, errRes := s.acquireRecognizer(r, pool)
+	if errRes != nil {
+		return nil, errRes
+	}
+	defer pool.Release(rec)
+
+	// Read the uploaded image and recognize the face in it
+	fileBytes, errRes := readImage(image)
+	if errRes != nil {
+		return nil, errRes
+	}
+	refFace, faceSelection, errRes := s.detectFace(rec, fileBytes, selection)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Refuse faces that would make a poor template
+	quality, errRes := checkQuality(fileBytes, refFace)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Convert embedding to string for storage
+	embeddingStr, err := helper.DescriptorToString(refFace.Descriptor)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error converting embedding to string: %v", err),
+		}
+	}
+
+	template := model.FaceTemplate{
+		Id:        primitive.NewObjectID().Hex(),
+		Embedding: embeddingStr,
+		Source:    source,
+		CreatedAt: time.Now().In(config.JakartaLocation),
+	}
+	recognizerParams := pool.Params()
+	template.Recognizer = &recognizerParams
+	template.ImageUrl = fmt.Sprintf("%s_%s_face_key.jpeg", user.Username, template.Id)
+
+	// Upload the file to storage
+	_, errRes = s.fileService.UploadBytes(fileBytes, template.ImageUrl)
+	if errRes != nil {
+		return nil, &helper.Response{
+			Status:  errRes.Status,
+			Message: fmt.Sprintf("Error uploading face template file: %v", errRes.Message),
+		}
+	}
+
+	// Save to database, removing the uploaded file again if that fails
+	collection := s.users
+	result, err := collection.UpdateOne(r, revisionFilter(user), map[string]any{
+		"$push": map[string]any{"go_face_templates": template},
+		"$inc":  map[string]any{"go_face_revision": 1},
+	})
+	if err != nil {
+		// The write may have been applied despite the error, the cleaner
+		// keeps the file if the user references it
+		s.fileCleaner.Schedule(r, template.ImageUrl, "add template failed")
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error saving face template: %v", err),
+		}
+	}
+	if result.MatchedCount == 0 {
+		s.fileCleaner.Schedule(r, template.ImageUrl, "add template conflict")
+		return nil, &helper.Response{
+			Status:  409,
+			Message: "Face key was changed by another request, please try again",
+		}
+	}
+
+	// Keep the identification index in sync with the new template
+	user.GoFaceTemplates = append(user.GoFaceTemplates, template)
+	user.GoFaceRevision++
+	s.faceIndex.Upsert(user)
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Face template added successfully",
+		Data: map[string]any{
+			"user_id":        user.Id,
+			"template":       faceTemplateResponse(template),
+			"template_count": len(user.FaceTemplates()),
+			"quality":        quality,
+			"face_selection": faceSelection,
+		},
+	}, nil
+}
+
+func (s *faceRecognitionService) ListFaceTemplates(r *gin.Context, username string) (*helper.Response, *helper.Response) {
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	templates := []map[string]any{}
+	for _, template := range user.FaceTemplates() {
+		templates = append(templates, faceTemplateResponse(template))
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Face templates retrieved successfully",
+		Data: map[string]any{
+			"user_id":   user.Id,
+			"username":  user.Username,
+			"templates": templates,
+		},
+	}, nil
+}
+
+func (s *faceRecognitionService) RemoveFaceTemplate(r *gin.Context, username string, templateId string) (res *helper.Response, errRes *helper.Response) {
+	defer func() { s.auditLog.RecordResult(r, "remove_template", username, res, errRes) }()
+
+	// Get user from database
+	user, errRes := s.findUser(r, username)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// Find the template to remove
+	var removed *model.FaceTemplate
+	for _, template := range user.FaceTemplates() {
+		if template.Id == templateId {
+			removed = &template
+			break
+		}
+	}
+	if removed == nil {
+		return nil, &helper.Response{
+			Status:  404,
+			Message: fmt.Sprintf("Face template %s not found", templateId),
+		}
+	}
+
+	// The primary template lives in the legacy fields, the others in the list
+	update := map[string]any{"$inc": map[string]any{"go_face_revision": 1}}
+	if removed.Id == model.PrimaryFaceTemplateId {
+		update["$set"] = map[string]any{
+			"go_face_image_url": "",
+			"go_face_embedding": "",
+		}
+		update["$unset"] = map[string]any{"go_face_recognizer": ""}
+		user.GoFaceImageUrl = ""
+		user.GoFaceEmbedding = ""
+		user.GoFaceRecognizer = nil
+	} else {
+		update["$pull"] = map[string]any{
+			"go_face_templates": map[string]any{"id": removed.Id},
+		}
+		remaining := make([]model.FaceTemplate, 0, len(user.GoFaceTemplates))
+		for _, template := range user.GoFaceTemplates {
+			if template.Id != removed.Id {
+				remaining = append(remaining, template)
+			}
+		}
+		user.GoFaceTemplates = remaining
+	}
+
+	collection := s.users
+	result, err := collection.UpdateOne(r, revisionFilter(user), update)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error removing face template: %v", err),
+		}
+	}
+	if result.MatchedCount == 0 {
+		return nil, &helper.Response{
+			Status:  409,
+			Message: "Face key was changed by another request, please try again",
+		}
+	}
+	user.GoFaceRevision++
+
+	// The database no longer references the image, delete it in the background
+	if removed.ImageUrl != "" {
+		s.fileCleaner.Schedule(r, removed.ImageUrl, "removed template")
+	}
+
+	// Keep the identification index in sync
+	s.faceIndex.Upsert(user)
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Face template removed successfully",
+		Data: map[string]any{
+			"user_id":        user.Id,
+			"template_id":    removed.Id,
+			"template_count": len(user.FaceTemplates()),
+		},
+	}, nil
+}
+
+// faceTemplateResponse describes a template without its raw embedding.
+func faceTemplateResponse(template model.FaceTemplate) map[string]any {
+	return map[string]any{
+		"id":         template.Id,
+		"image_url":  template.ImageUrl,
+		"source":     template.Source,
+		"recognizer": template.Recognizer,
+		"created_at": template.CreatedAt,
+	}
+}
+
+// aggregateDistances combines the distances to each template into a single
+// score ("min", "mean" or "median") and returns it together with the index
+// of the closest template.
+func aggregateDistances(distances []float32, mode string) (float32, int) {
+	best := 0
+	for i, distance := range distances {
+		if distance < distances[best] {
+			best = i
+		}
+	}
+
+	switch mode {
+	case "mean":
+		var sum float32
+		for _, distance := range distances {
+			sum += distance
+		}
+		return sum / float32(len(distances)), best
+	case "median":
+		sorted := append([]float32(nil), distances...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		mid := len(sorted) / 2
+		if len(sorted)%2 == 0 {
+			return (sorted[mid-1] + sorted[mid]) / 2, best
+		}
+		return sorted[mid], best
+	default:
+		return distances[best], best
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+import "testing"
+
+func TestAggregateDistances(t *testing.T) {
+	tests := []struct {
+		name      string
+		distances []float32
+		mode      string
+		want      float32
+		wantBest  int
+	}{
+		{"single template", []float32{0.42}, "min", 0.42, 0},
+		{"min", []float32{0.5, 0.3, 0.4}, "min", 0.3, 1},
+		{"unknown mode falls back to min", []float32{0.5, 0.3, 0.4}, "max", 0.3, 1},
+		{"mean", []float32{0.2, 0.4, 0.6}, "mean", 0.4, 0},
+		{"median of odd count", []float32{0.6, 0.2, 0.5}, "median", 0.5, 1},
+		{"median of even count", []float32{0.6, 0.2, 0.4, 0.3}, "median", 0.35, 1},
+		{"first of equal distances is closest", []float32{0.3, 0.3}, "min", 0.3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			distances := append([]float32(nil), tt.distances...)
+			got, best := aggregateDistances(distances, tt.mode)
+			if !approxEqual(got, tt.want) || best != tt.wantBest {
+				t.Errorf("aggregateDistances(%v, %q) = %v, %d, want %v, %d", tt.distances, tt.mode, got, best, tt.want, tt.wantBest)
+			}
+			for i := range distances {
+				if distances[i] != tt.distances[i] {
+					t.Fatalf("aggregateDistances reordered its input to %v", distances)
+				}
+			}
+		})
+	}
+}
+
+func approxEqual(a, b float32) bool {
+	diff := a - b
+	return diff < 1e-6 && diff > -1e-6
+}
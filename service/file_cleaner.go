@@ -0,0 +1,191 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/model"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const pendingFileDeletionCollection = "face_pending_deletion"
+
+// maxFileDeleteBackoff caps the delay between two attempts on the same file.
+const maxFileDeleteBackoff = time.Hour
+
+// FileCleaner removes files that are no longer referenced by any user. The
+// deletions are recorded in Mongo first, so a failed or interrupted delete
+// is retried later instead of leaving an orphaned file behind. A file a user
+// still references is never deleted: a write that returned an error may
+// have been applied anyway.
+type FileCleaner interface {
+	Schedule(ctx context.Context, fileName string, reason string)
+	Run(ctx context.Context)
+}
+
+type fileCleaner struct {
+	pending     mongoCollection
+	users       mongoCollection
+	fileService FileService
+	wake        chan struct{}
+}
+
+func NewFileCleaner(mongo *mongo.Client, fileService FileService) FileCleaner {
+	return &fileCleaner{
+		pending:     mongo.Database(config.MONGO_DB).Collection(pendingFileDeletionCollection),
+		users:       userCollection(mongo),
+		fileService: fileService,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Schedule records fileName for deletion and wakes the background worker.
+func (c *fileCleaner) Schedule(ctx context.Context, fileName string, reason string) {
+	if fileName == "" {
+		return
+	}
+
+	now := time.Now().In(config.JakartaLocation)
+	_, err := c.pending.UpdateOne(
+		ctx,
+		map[string]any{"file_name": fileName},
+		map[string]any{"$setOnInsert": model.PendingFileDeletion{
+			FileName:      fileName,
+			Reason:        reason,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		// Without the record there is nothing to retry, so try once right away
+		log.Printf("Error scheduling deletion of %s: %v", fileName, err)
+		go c.delete(context.Background(), fileName)
+		return
+	}
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes due deletions until ctx is done.
+func (c *fileCleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(config.FILE_DELETE_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		c.processDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+	}
+}
+
+func (c *fileCleaner) processDue(ctx context.Context) {
+	now := time.Now().In(config.JakartaLocation)
+	cursor, err := c.pending.Find(
+		ctx,
+		map[string]any{
+			"next_attempt_at": map[string]any{"$lte": now},
+			"attempts":        map[string]any{"$lt": config.FILE_DELETE_MAX_ATTEMPTS},
+		},
+		options.Find().SetLimit(50),
+	)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error loading pending file deletions: %v", err)
+		}
+		return
+	}
+
+	var pending []model.PendingFileDeletion
+	if err := cursor.All(ctx, &pending); err != nil {
+		log.Printf("Error decoding pending file deletions: %v", err)
+		return
+	}
+
+	for _, p := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+
+		filter := map[string]any{"file_name": p.FileName}
+		errMessage := c.delete(ctx, p.FileName)
+		if errMessage == "" {
+			if _, err := c.pending.DeleteOne(ctx, filter); err != nil {
+				log.Printf("Error clearing pending deletion of %s: %v", p.FileName, err)
+			}
+			continue
+		}
+
+		attempts := p.Attempts + 1
+		if attempts >= config.FILE_DELETE_MAX_ATTEMPTS {
+			log.Printf("Giving up deleting %s after %d attempts: %s", p.FileName, attempts, errMessage)
+		}
+		_, err := c.pending.UpdateOne(ctx, filter, map[string]any{"$set": map[string]any{
+			"attempts":        attempts,
+			"last_error":      errMessage,
+			"next_attempt_at": now.Add(fileDeleteBackoff(attempts)),
+		}})
+		if err != nil {
+			log.Printf("Error rescheduling deletion of %s: %v", p.FileName, err)
+		}
+	}
+}
+
+// delete removes the file and returns an error message, empty on success.
+// A file that is already gone, or still referenced by a user and so not to
+// be deleted, counts as done.
+func (c *fileCleaner) delete(ctx context.Context, fileName string) string {
+	referenced, err := c.referenced(ctx, fileName)
+	if err != nil {
+		return fmt.Sprintf("Error checking references to %s: %v", fileName, err)
+	}
+	if referenced {
+		log.Printf("Keeping %s, it is still referenced by a user", fileName)
+		return ""
+	}
+
+	_, errRes := c.fileService.DeleteFile(fileName)
+	if errRes != nil && errRes.Status != http.StatusNotFound {
+		return errRes.Message
+	}
+	return ""
+}
+
+// referenced tells whether a user points at fileName, as face key image or
+// as template image.
+func (c *fileCleaner) referenced(ctx context.Context, fileName string) (bool, error) {
+	count, err := c.users.CountDocuments(
+		ctx,
+		map[string]any{"$or": []map[string]any{
+			{"go_face_image_url": fileName},
+			{"go_face_templates.image_url": fileName},
+		}},
+		options.Count().SetLimit(1),
+	)
+	return count > 0, err
+}
+
+// fileDeleteBackoff doubles the retry interval with every failed attempt.
+func fileDeleteBackoff(attempts int) time.Duration {
+	backoff := config.FILE_DELETE_RETRY_INTERVAL
+	for i := 1; i < attempts && backoff < maxFileDeleteBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxFileDeleteBackoff {
+		backoff = maxFileDeleteBackoff
+	}
+	return backoff
+}
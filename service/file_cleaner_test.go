@@ -0,0 +1,250 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/model"
+	"arkan-face-key/storage"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// flakyStorage fails the first deletes, like an unreachable SFTP server.
+type flakyStorage struct {
+	storage.Storage
+	mu       sync.Mutex
+	failures int
+	deletes  int
+}
+
+func (s *flakyStorage) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	s.deletes++
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		return errors.New("connection reset")
+	}
+	s.mu.Unlock()
+	return s.Storage.Delete(ctx, name)
+}
+
+func withFileCleanerConfig(t *testing.T) {
+	requireTimeZone(t)
+	attempts, interval := config.FILE_DELETE_MAX_ATTEMPTS, config.FILE_DELETE_RETRY_INTERVAL
+	t.Cleanup(func() {
+		config.FILE_DELETE_MAX_ATTEMPTS, config.FILE_DELETE_RETRY_INTERVAL = attempts, interval
+	})
+	config.FILE_DELETE_MAX_ATTEMPTS = 3
+	config.FILE_DELETE_RETRY_INTERVAL = time.Minute
+}
+
+func newTestFileCleaner(t *testing.T, store storage.Storage, files ...string) (*fileCleaner, *fakeCollection, *fakeCollection) {
+	t.Helper()
+	for _, name := range files {
+		if err := store.Put(context.Background(), name, strings.NewReader("jpeg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending, users := newFakeCollection(), newFakeCollection()
+	return &fileCleaner{
+		pending:     pending,
+		users:       users,
+		fileService: NewFileService(store),
+		wake:        make(chan struct{}, 1),
+	}, pending, users
+}
+
+func storedFiles(t *testing.T, store storage.Storage) []string {
+	t.Helper()
+	names, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func pendingDeletion(t *testing.T, pending *fakeCollection, fileName string) *model.PendingFileDeletion {
+	t.Helper()
+	d := pending.first(bson.M{"file_name": fileName})
+	if d == nil {
+		return nil
+	}
+	var deletion model.PendingFileDeletion
+	data, err := bson.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bson.Unmarshal(data, &deletion); err != nil {
+		t.Fatal(err)
+	}
+	return &deletion
+}
+
+func TestFileCleanerDeletesUnreferencedFiles(t *testing.T) {
+	withFileCleanerConfig(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	c, pending, _ := newTestFileCleaner(t, store, "arman_1_face_key.jpeg", "budi_1_face_key.jpeg")
+
+	c.Schedule(ctx, "arman_1_face_key.jpeg", "replaced face key")
+	c.Schedule(ctx, "arman_1_face_key.jpeg", "deleted face key")
+	c.Schedule(ctx, "missing.jpeg", "removed template")
+	if pending.len() != 2 {
+		t.Fatalf("%d pending deletions, want one per file", pending.len())
+	}
+	if deletion := pendingDeletion(t, pending, "arman_1_face_key.jpeg"); deletion.Reason != "replaced face key" {
+		t.Errorf("reason = %q, want the first one", deletion.Reason)
+	}
+
+	c.processDue(ctx)
+
+	// A file that is already gone counts as deleted too
+	if names := storedFiles(t, store); len(names) != 1 || names[0] != "budi_1_face_key.jpeg" {
+		t.Errorf("stored files = %v", names)
+	}
+	if pending.len() != 0 {
+		t.Errorf("%d pending deletions left", pending.len())
+	}
+}
+
+// TestFileCleanerKeepsReferencedFiles covers a write that returned an error
+// but was applied: the user references the file that was scheduled.
+func TestFileCleanerKeepsReferencedFiles(t *testing.T) {
+	withFileCleanerConfig(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	c, pending, users := newTestFileCleaner(t, store, "face_key.jpeg", "template.jpeg", "orphan.jpeg")
+	users.InsertOne(ctx, model.User{
+		Username:       "arman",
+		GoFaceImageUrl: "face_key.jpeg",
+		GoFaceTemplates: []model.FaceTemplate{
+			{Id: "t1", ImageUrl: "template.jpeg"},
+		},
+	})
+
+	for _, name := range []string{"face_key.jpeg", "template.jpeg", "orphan.jpeg"} {
+		c.Schedule(ctx, name, "enrollment failed")
+	}
+	c.processDue(ctx)
+
+	if names := storedFiles(t, store); len(names) != 2 || names[0] != "face_key.jpeg" || names[1] != "template.jpeg" {
+		t.Errorf("stored files = %v, want the referenced ones", names)
+	}
+	if pending.len() != 0 {
+		t.Errorf("%d pending deletions left, kept files count as done", pending.len())
+	}
+}
+
+func TestFileCleanerRetriesFailedDeletes(t *testing.T) {
+	withFileCleanerConfig(t)
+	ctx := context.Background()
+	store := &flakyStorage{Storage: storage.NewMemoryStorage(), failures: 2}
+	c, pending, _ := newTestFileCleaner(t, store, "arman_1_face_key.jpeg")
+
+	c.Schedule(ctx, "arman_1_face_key.jpeg", "replaced face key")
+	c.processDue(ctx)
+
+	deletion := pendingDeletion(t, pending, "arman_1_face_key.jpeg")
+	if deletion == nil || deletion.Attempts != 1 || deletion.LastError != "connection reset" {
+		t.Fatalf("pending deletion = %+v, want one failed attempt", deletion)
+	}
+	if wait := time.Until(deletion.NextAttemptAt); wait <= 50*time.Second || wait > time.Minute {
+		t.Errorf("next attempt in %s, want about 1m", wait)
+	}
+
+	// Not due yet
+	c.processDue(ctx)
+	if store.deletes != 1 {
+		t.Errorf("%d deletes before the retry was due", store.deletes)
+	}
+
+	makeDue := func() {
+		pending.UpdateOne(ctx, map[string]any{"file_name": "arman_1_face_key.jpeg"}, map[string]any{
+			"$set": map[string]any{"next_attempt_at": time.Now().Add(-time.Second)},
+		})
+	}
+	makeDue()
+	c.processDue(ctx)
+	deletion = pendingDeletion(t, pending, "arman_1_face_key.jpeg")
+	if wait := time.Until(deletion.NextAttemptAt); deletion.Attempts != 2 || wait <= 110*time.Second || wait > 2*time.Minute {
+		t.Errorf("pending deletion = %+v, want a second attempt retried in 2m", deletion)
+	}
+
+	makeDue()
+	c.processDue(ctx)
+	if pending.len() != 0 || len(storedFiles(t, store)) != 0 {
+		t.Errorf("file not deleted on the third attempt")
+	}
+}
+
+func TestFileCleanerGivesUp(t *testing.T) {
+	withFileCleanerConfig(t)
+	ctx := context.Background()
+	store := &flakyStorage{Storage: storage.NewMemoryStorage(), failures: 100}
+	c, pending, _ := newTestFileCleaner(t, store, "arman_1_face_key.jpeg")
+
+	c.Schedule(ctx, "arman_1_face_key.jpeg", "replaced face key")
+	for i := 0; i < 5; i++ {
+		c.processDue(ctx)
+		pending.UpdateOne(ctx, map[string]any{"file_name": "arman_1_face_key.jpeg"}, map[string]any{
+			"$set": map[string]any{"next_attempt_at": time.Now().Add(-time.Second)},
+		})
+	}
+
+	if store.deletes != config.FILE_DELETE_MAX_ATTEMPTS {
+		t.Errorf("%d deletes, want FILE_DELETE_MAX_ATTEMPTS", store.deletes)
+	}
+	if deletion := pendingDeletion(t, pending, "arman_1_face_key.jpeg"); deletion == nil || deletion.Attempts != config.FILE_DELETE_MAX_ATTEMPTS {
+		t.Errorf("pending deletion = %+v, want it kept for inspection", deletion)
+	}
+}
+
+func TestFileCleanerRunWakesOnSchedule(t *testing.T) {
+	withFileCleanerConfig(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	store := storage.NewMemoryStorage()
+	c, _, _ := newTestFileCleaner(t, store, "arman_1_face_key.jpeg")
+
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	c.Schedule(ctx, "arman_1_face_key.jpeg", "replaced face key")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storedFiles(t, store)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("file not deleted after Schedule woke the worker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestFileDeleteBackoff(t *testing.T) {
+	withFileCleanerConfig(t)
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, maxFileDeleteBackoff},
+		{50, maxFileDeleteBackoff},
+	}
+	for _, tt := range tests {
+		if got := fileDeleteBackoff(tt.attempts); got != tt.want {
+			t.Errorf("fileDeleteBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"arkan-face-key/helper"
+	"arkan-face-key/storage"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+type FileService interface {
+	UploadFile(file *multipart.FileHeader, fileName string) (*helper.Response, *helper.Response)
+	UploadBytes(data []byte, fileName string) (*helper.Response, *helper.Response)
+	ReadFile(fileName string) ([]byte, *helper.Response)
+	DeleteFile(fileName string) (*helper.Response, *helper.Response)
+	DownloadFile(fileName string) (*helper.Response, *helper.Response)
+	GetListOfFile() (*helper.Response, *helper.Response)
+}
+
+type fileService struct {
+	storage storage.Storage
+}
+
+func NewFileService(storage storage.Storage) FileService {
+	return &fileService{storage: storage}
+}
+
+func (s *fileService) UploadFile(file *multipart.FileHeader, fileName string) (*helper.Response, *helper.Response) {
+	if s.storage == nil {
+		return nil, &helper.Response{
+			Status:  http.StatusInternalServerError,
+			Message: "File storage is not initialized",
+		}
+	}
+
+	srcFile, err := file.Open()
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+	defer srcFile.Close()
+
+	err = s.storage.Put(context.Background(), fileName, srcFile)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+
+	return &helper.Response{
+		Status:  http.StatusOK,
+		Message: "File uploaded successfully",
+		Data:    fileName,
+	}, nil
+}
+
+// UploadBytes stores data, e.g. an image after preprocessing.
+func (s *fileService) UploadBytes(data []byte, fileName string) (*helper.Response, *helper.Response) {
+	if s.storage == nil {
+		return nil, &helper.Response{
+			Status:  http.StatusInternalServerError,
+			Message: "File storage is not initialized",
+		}
+	}
+
+	err := s.storage.Put(context.Background(), fileName, bytes.NewReader(data))
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+
+	return &helper.Response{
+		Status:  http.StatusOK,
+		Message: "File uploaded successfully",
+		Data:    fileName,
+	}, nil
+}
+
+// ReadFile loads a whole stored file into memory.
+func (s *fileService) ReadFile(fileName string) ([]byte, *helper.Response) {
+	if s.storage == nil {
+		return nil, &helper.Response{
+			Status:  http.StatusInternalServerError,
+			Message: "File storage is not initialized",
+		}
+	}
+
+	srcFile, err := s.storage.Get(context.Background(), fileName)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, &helper.Response{
+				Status:  http.StatusNotFound,
+				Message: "File " + fileName + " not found",
+			}
+		}
+		return nil, &helper.Response{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+	defer srcFile.Close()
+
+	data, err := io.ReadAll(srcFile)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+	return data, nil
+}
+
+func (s *fileService) DeleteFile(fileName string) (*helper.Response, *helper.Response) {
+	if s.storage == nil {
+		return nil, &helper.Response{
+			Status:  http.StatusInternalServerError,
+			Message: "File storage is not initialized",
+		}
+	}
+
+	err := s.storage.Delete(context.Background(), fileName)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, &helper.Response{
+				Status:  http.StatusNotFound,
+				Message: "File " + fileName + " not found",
+			}
+		}
+		return nil, &helper.Response{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+
+	return &helper.Response{
+		Status:  http.StatusOK,
+		Message: "File deleted successfully",
+	}, nil
+}
+
+// DownloadFile returns the stored file content in Data, kept in memory
+// rather than written to tmp_file.
+func (s *fileService) DownloadFile(fileName string) (*helper.Response, *helper.Response) {
+	data, errRes := s.ReadFile(fileName)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	return &helper.Response{
+		Status:  http.StatusOK,
+		Message: "File downloaded successfully",
+		Data:    data,
+	}, nil
+}
+
+func (s *fileService) GetListOfFile() (*helper.Response, *helper.Response) {
+	if s.storage == nil {
+		return nil, &helper.Response{
+			Status:  http.StatusInternalServerError,
+			Message: "File storage is not initialized",
+		}
+	}
+
+	fileNames, err := s.storage.List(context.Background())
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+
+	return &helper.Response{
+		Status:  http.StatusOK,
+		Message: "List of files retrieved successfully",
+		Data:    fileNames,
+	}, nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const idempotencyCollection = "face_idempotency"
+
+// idempotencyTTL is how long a completed response is replayed for.
+const idempotencyTTL = 24 * time.Hour
+
+// idempotencyLease is how long a request holds its key before a retry may
+// take it over, in case the process died without aborting it.
+const idempotencyLease = 2 * time.Minute
+
+var (
+	ErrIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still being processed")
+	ErrIdempotencyMismatch   = errors.New("this Idempotency-Key was already used for a different request")
+)
+
+// IdempotencyStore remembers the response of successful requests by their
+// Idempotency-Key so client retries replay it instead of running again.
+type IdempotencyStore interface {
+	EnsureIndexes(ctx context.Context) error
+	// Begin claims key for the request with requestHash. It returns the
+	// stored response when the key was already completed,
+	// ErrIdempotencyMismatch when it was used for another request, or
+	// ErrIdempotencyInProgress while another request holds it.
+	Begin(ctx context.Context, key string, requestHash string) (*helper.Response, error)
+	Complete(ctx context.Context, key string, res *helper.Response) error
+	Abort(ctx context.Context, key string)
+}
+
+type idempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	RequestHash string    `bson:"request_hash"`
+	Completed   bool      `bson:"completed"`
+	Response    string    `bson:"response"`
+	StartedAt   time.Time `bson:"started_at"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+type idempotencyStore struct {
+	records mongoCollection
+}
+
+func NewIdempotencyStore(mongo *mongo.Client) IdempotencyStore {
+	return &idempotencyStore{records: mongo.Database(config.MONGO_DB).Collection(idempotencyCollection)}
+}
+
+// EnsureIndexes lets Mongo expire old keys on its own.
+func (s *idempotencyStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.records.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    map[string]any{"created_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(idempotencyTTL.Seconds())),
+	})
+	return err
+}
+
+func (s *idempotencyStore) Begin(ctx context.Context, key string, requestHash string) (*helper.Response, error) {
+	now := time.Now().In(config.JakartaLocation)
+	_, err := s.records.InsertOne(ctx, idempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		StartedAt:   now,
+		CreatedAt:   now,
+	})
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var record idempotencyRecord
+	if err := s.records.FindOne(ctx, map[string]any{"_id": key}).Decode(&record); err != nil {
+		return nil, err
+	}
+	if record.RequestHash != requestHash {
+		return nil, ErrIdempotencyMismatch
+	}
+	if !record.Completed {
+		return nil, s.takeOver(ctx, record, now)
+	}
+
+	var res helper.Response
+	if err := json.Unmarshal([]byte(record.Response), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *idempotencyStore) Complete(ctx context.Context, key string, res *helper.Response) error {
+	response, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	_, err = s.records.UpdateOne(
+		ctx,
+		map[string]any{"_id": key},
+		map[string]any{"$set": map[string]any{"completed": true, "response": string(response)}},
+	)
+	return err
+}
+
+// takeOver claims an in-progress record whose lease expired, so a request
+// that crashed before Abort doesn't block its key until the TTL. Only one
+// of concurrent retries wins, the others are still in progress.
+func (s *idempotencyStore) takeOver(ctx context.Context, record idempotencyRecord, now time.Time) error {
+	if now.Sub(record.StartedAt) < idempotencyLease {
+		return ErrIdempotencyInProgress
+	}
+	result, err := s.records.UpdateOne(
+		ctx,
+		map[string]any{"_id": record.Key, "completed": false, "started_at": record.StartedAt},
+		map[string]any{"$set": map[string]any{"started_at": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrIdempotencyInProgress
+	}
+	return nil
+}
+
+// Abort releases key after a failed request so the client can retry it.
+func (s *idempotencyStore) Abort(ctx context.Context, key string) {
+	s.records.DeleteOne(ctx, map[string]any{"_id": key, "completed": false})
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"arkan-face-key/helper"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStoreReplaysCompletedResponse(t *testing.T) {
+	requireTimeZone(t)
+	ctx := context.Background()
+	s := &idempotencyStore{records: newFakeCollection()}
+
+	if res, err := s.Begin(ctx, "key-1", "hash-a"); res != nil || err != nil {
+		t.Fatalf("first Begin() = %v, %v", res, err)
+	}
+	if _, err := s.Begin(ctx, "key-1", "hash-a"); !errors.Is(err, ErrIdempotencyInProgress) {
+		t.Errorf("Begin() while in progress error = %v", err)
+	}
+
+	saved := &helper.Response{Status: 200, Message: "Face key saved successfully", Data: map[string]any{"revision": 2}}
+	if err := s.Complete(ctx, "key-1", saved); err != nil {
+		t.Fatal(err)
+	}
+	// Abort after completion must not forget the response
+	s.Abort(ctx, "key-1")
+
+	res, err := s.Begin(ctx, "key-1", "hash-a")
+	if err != nil || res == nil || res.Status != 200 || res.Message != saved.Message {
+		t.Fatalf("Begin() after Complete = %+v, %v, want the saved response", res, err)
+	}
+	if data, ok := res.Data.(map[string]any); !ok || data["revision"] != float64(2) {
+		t.Errorf("replayed data = %v", res.Data)
+	}
+}
+
+func TestIdempotencyStoreRejectsOtherRequest(t *testing.T) {
+	requireTimeZone(t)
+	ctx := context.Background()
+	s := &idempotencyStore{records: newFakeCollection()}
+
+	s.Begin(ctx, "key-1", "hash-a")
+	s.Complete(ctx, "key-1", &helper.Response{Status: 200})
+
+	if _, err := s.Begin(ctx, "key-1", "hash-b"); !errors.Is(err, ErrIdempotencyMismatch) {
+		t.Errorf("Begin() with another request error = %v, want ErrIdempotencyMismatch", err)
+	}
+}
+
+func TestIdempotencyStoreAbortReleasesKey(t *testing.T) {
+	requireTimeZone(t)
+	ctx := context.Background()
+	s := &idempotencyStore{records: newFakeCollection()}
+
+	s.Begin(ctx, "key-1", "hash-a")
+	s.Abort(ctx, "key-1")
+	if res, err := s.Begin(ctx, "key-1", "hash-a"); res != nil || err != nil {
+		t.Errorf("Begin() after Abort = %v, %v, want the key free", res, err)
+	}
+}
+
+// TestIdempotencyStoreTakesOverExpiredLease covers a request that died
+// without Abort: once its lease expired exactly one of the concurrent
+// retries may run.
+func TestIdempotencyStoreTakesOverExpiredLease(t *testing.T) {
+	requireTimeZone(t)
+	ctx := context.Background()
+	records := newFakeCollection()
+	s := &idempotencyStore{records: records}
+
+	startedAt := time.Now().Add(-idempotencyLease - time.Second)
+	records.InsertOne(ctx, idempotencyRecord{
+		Key:         "key-1",
+		RequestHash: "hash-a",
+		StartedAt:   startedAt,
+		CreatedAt:   startedAt,
+	})
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Begin(ctx, "key-1", "hash-a")
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var claimed int
+	for err := range results {
+		switch {
+		case err == nil:
+			claimed++
+		case !errors.Is(err, ErrIdempotencyInProgress):
+			t.Errorf("Begin() error = %v", err)
+		}
+	}
+	if claimed != 1 {
+		t.Errorf("%d retries took over the key, want 1", claimed)
+	}
+
+	// The new holder has a fresh lease
+	if _, err := s.Begin(ctx, "key-1", "hash-a"); !errors.Is(err, ErrIdempotencyInProgress) {
+		t.Errorf("Begin() after the takeover error = %v, want in progress", err)
+	}
+}
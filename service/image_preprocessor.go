@@ -0,0 +1,200 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// imageFormat decodes an image, or only its header to check its size
+// before allocating the pixels.
+type imageFormat struct {
+	decode       func(r io.Reader) (image.Image, error)
+	decodeConfig func(r io.Reader) (image.Config, error)
+}
+
+// Image content types accepted by preprocessImage, sniffed from the bytes
+// rather than trusted from the file name.
+var imageFormats = map[string]imageFormat{
+	"image/jpeg": {jpeg.Decode, jpeg.DecodeConfig},
+	"image/png":  {png.Decode, png.DecodeConfig},
+	"image/gif":  {gif.Decode, gif.DecodeConfig},
+	"image/webp": {webp.Decode, webp.DecodeConfig},
+	"image/bmp":  {bmp.Decode, bmp.DecodeConfig},
+}
+
+// preprocessImage turns an uploaded image into the upright JPEG go-face
+// can recognize: PNG, WebP, BMP and GIF (first frame) are decoded, the EXIF
+// orientation of camera photos applied and images larger than
+// IMAGE_MAX_DIMENSION scaled down. An upright JPEG that is small enough is
+// returned as is, to not lose quality re-encoding it. Images of more than
+// IMAGE_MAX_MEGAPIXELS are refused before decoding, a small file can
+// declare a size that takes gigabytes to decode.
+func preprocessImage(data []byte) ([]byte, error) {
+	contentType := http.DetectContentType(data)
+	format, ok := imageFormats[contentType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image type %s, expected JPEG, PNG, WebP, BMP or GIF", contentType)
+	}
+
+	size, err := format.decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if tooManyPixels(size.Width, size.Height) {
+		return nil, fmt.Errorf("image of %dx%d pixels is larger than %d megapixels", size.Width, size.Height, config.IMAGE_MAX_MEGAPIXELS)
+	}
+
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+		if orientation == 1 && !oversized(size.Width, size.Height) {
+			return data, nil
+		}
+	}
+
+	img, err := format.decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img = orient(downsize(img), orientation)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: config.IMAGE_JPEG_QUALITY}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func tooManyPixels(width int, height int) bool {
+	return int64(width)*int64(height) > int64(config.IMAGE_MAX_MEGAPIXELS)*1000000
+}
+
+func oversized(width int, height int) bool {
+	return config.IMAGE_MAX_DIMENSION > 0 && max(width, height) > config.IMAGE_MAX_DIMENSION
+}
+
+// downsize scales img so its longer side is IMAGE_MAX_DIMENSION, or copies
+// it into an RGBA image for orient when it is small enough.
+func downsize(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	if !oversized(bounds.Dx(), bounds.Dy()) {
+		rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		return rgba
+	}
+
+	scale := float64(config.IMAGE_MAX_DIMENSION) / float64(max(bounds.Dx(), bounds.Dy()))
+	width := max(1, int(float64(bounds.Dx())*scale+0.5))
+	height := max(1, int(float64(bounds.Dy())*scale+0.5))
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(rgba, rgba.Bounds(), img, bounds, xdraw.Src, nil)
+	return rgba
+}
+
+// orient applies an EXIF orientation (1-8), so the image displays upright
+// without it.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		// 5-8 swap width and height
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			// Source pixel of each destination pixel
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated 90° counterclockwise, turn it clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90° clockwise, turn it counterclockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[img.PixOffset(sx, sy):img.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the orientation tag of the EXIF segment of a JPEG,
+// 1 (upright) when there is none.
+func jpegOrientation(data []byte) int {
+	// Walk the segments up to the image data: marker, then a big endian
+	// length that includes itself
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xda || length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds tag 0x0112 in the first IFD of a TIFF header.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
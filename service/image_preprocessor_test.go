@@ -0,0 +1,210 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// exifSegment is an APP1 segment with a TIFF header holding one IFD entry,
+// the orientation.
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	entry := tiff[10:]
+	order.PutUint16(entry, 0x0112)
+	order.PutUint16(entry[2:], 3) // SHORT
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], orientation)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testJpeg encodes a width x height JPEG, with segment inserted right after
+// the start of image marker.
+func testJpeg(t *testing.T, width, height int, segment []byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"little endian", testJpeg(t, 2, 2, exifSegment(binary.LittleEndian, 6)), 6},
+		{"big endian", testJpeg(t, 2, 2, exifSegment(binary.BigEndian, 8)), 8},
+		{"no exif", testJpeg(t, 2, 2, nil), 1},
+		{"out of range", testJpeg(t, 2, 2, exifSegment(binary.BigEndian, 9)), 1},
+		{"truncated", testJpeg(t, 2, 2, exifSegment(binary.LittleEndian, 3))[:20], 1},
+		{"not a jpeg", []byte("GIF89a"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != tt.want {
+				t.Errorf("jpegOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExifOrientationInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+	}{
+		{"empty", nil},
+		{"unknown byte order", []byte("XX\x00\x2a\x00\x00\x00\x08\x00\x00")},
+		{"ifd outside", []byte("II\x2a\x00\xff\x00\x00\x00")},
+		{"ifd in header", []byte("MM\x00\x2a\x00\x00\x00\x02\x00\x00")},
+		{"entries cut off", []byte("II\x2a\x00\x08\x00\x00\x00\x05\x00\x12\x01")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.tiff); got != 1 {
+				t.Errorf("exifOrientation() = %d, want 1", got)
+			}
+		})
+	}
+}
+
+// TestOrient turns the 3x2 image
+//
+//	a b c
+//	d e f
+//
+// upright for every orientation.
+func TestOrient(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i, r := range "abcdef" {
+		src.SetRGBA(i%3, i/3, color.RGBA{R: uint8(r), A: 255})
+	}
+
+	tests := []struct {
+		orientation int
+		want        []string
+	}{
+		{0, []string{"abc", "def"}},
+		{1, []string{"abc", "def"}},
+		{2, []string{"cba", "fed"}},
+		{3, []string{"fed", "cba"}},
+		{4, []string{"def", "abc"}},
+		{5, []string{"ad", "be", "cf"}},
+		{6, []string{"da", "eb", "fc"}},
+		{7, []string{"fc", "eb", "da"}},
+		{8, []string{"cf", "be", "ad"}},
+		{9, []string{"abc", "def"}},
+	}
+	for _, tt := range tests {
+		dst := orient(src, tt.orientation)
+		var got []string
+		for y := 0; y < dst.Rect.Dy(); y++ {
+			var row strings.Builder
+			for x := 0; x < dst.Rect.Dx(); x++ {
+				row.WriteByte(dst.RGBAAt(x, y).R)
+			}
+			got = append(got, row.String())
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("orient(%d) = %v, want %v", tt.orientation, got, tt.want)
+		}
+	}
+}
+
+// pngHeader is a PNG that ends after its IHDR chunk, enough for
+// DecodeConfig but not for Decode.
+func pngHeader(width, height uint32) []byte {
+	chunk := make([]byte, 4+13)
+	copy(chunk, "IHDR")
+	binary.BigEndian.PutUint32(chunk[4:], width)
+	binary.BigEndian.PutUint32(chunk[8:], height)
+	chunk[12] = 8 // bit depth
+	chunk[13] = 2 // truecolor
+
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, chunk...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(chunk))
+}
+
+func testPng(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPreprocessImage(t *testing.T) {
+	megapixels, dimension, quality := config.IMAGE_MAX_MEGAPIXELS, config.IMAGE_MAX_DIMENSION, config.IMAGE_JPEG_QUALITY
+	t.Cleanup(func() {
+		config.IMAGE_MAX_MEGAPIXELS, config.IMAGE_MAX_DIMENSION, config.IMAGE_JPEG_QUALITY = megapixels, dimension, quality
+	})
+	config.IMAGE_MAX_MEGAPIXELS = 50
+	config.IMAGE_MAX_DIMENSION = 16
+	config.IMAGE_JPEG_QUALITY = 90
+
+	upright := testJpeg(t, 8, 4, nil)
+
+	tests := []struct {
+		name                  string
+		data                  []byte
+		wantErr               string
+		wantWidth, wantHeight int
+		wantUnchanged         bool
+	}{
+		{name: "upright jpeg kept", data: upright, wantWidth: 8, wantHeight: 4, wantUnchanged: true},
+		{name: "rotated jpeg", data: testJpeg(t, 8, 4, exifSegment(binary.LittleEndian, 6)), wantWidth: 4, wantHeight: 8},
+		{name: "large jpeg scaled down", data: testJpeg(t, 32, 8, nil), wantWidth: 16, wantHeight: 4},
+		{name: "png converted", data: testPng(t, 6, 3), wantWidth: 6, wantHeight: 3},
+		{name: "pixel bomb refused before decoding", data: pngHeader(30000, 30000), wantErr: "larger than 50 megapixels"},
+		{name: "truncated png", data: pngHeader(4, 4), wantErr: "EOF"},
+		{name: "not an image", data: []byte("%PDF-1.7\n"), wantErr: "unsupported image type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := preprocessImage(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantUnchanged && !bytes.Equal(got, tt.data) {
+				t.Error("upright JPEG was re-encoded")
+			}
+
+			size, err := jpeg.DecodeConfig(bytes.NewReader(got))
+			if err != nil {
+				t.Fatalf("result is not a JPEG: %v", err)
+			}
+			if size.Width != tt.wantWidth || size.Height != tt.wantHeight {
+				t.Errorf("size = %dx%d, want %dx%d", size.Width, size.Height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const faceLivenessChallengeCollection = "face_liveness_challenge"
+
+// Liveness actions. Left and right are the user's own, so turning left
+// moves the nose to the right of an unmirrored camera frame.
+const (
+	LivenessTurnLeft  = "turn_left"
+	LivenessTurnRight = "turn_right"
+)
+
+// livenessBlink needs the eyelids of the 68 point landmark model. go-face
+// hard codes shape_predictor_5_face_landmarks.dat in facerec.cc, so blinks
+// can't be detected until the recognizer can load another shape predictor.
+const livenessBlink = "blink"
+
+// frontalYaw is the largest yaw of the frame facing the camera that starts
+// every sequence.
+const frontalYaw = 0.15
+
+var livenessActions = []string{LivenessTurnLeft, LivenessTurnRight}
+
+// LivenessResult reports what was seen in the frames of a liveness
+// verification.
+type LivenessResult struct {
+	ChallengeId string   `json:"challenge_id"`
+	Actions     []string `json:"actions"`
+	Performed   []string `json:"performed"`
+	FrameCount  int      `json:"frame_count"`
+	Passed      bool     `json:"passed"`
+	Reason      string   `json:"reason,omitempty"`
+}
+
+// LivenessService issues the one-time challenges of the active liveness
+// flow: the client asks for a challenge, films the user performing its
+// actions and uploads the frames with the challenge id.
+type LivenessService interface {
+	EnsureIndexes(ctx context.Context) error
+	IssueChallenge(r *gin.Context, username string) (*helper.Response, *helper.Response)
+	// Consume marks the challenge used and returns it, nil when it doesn't
+	// exist, belongs to someone else, expired or was already used.
+	Consume(ctx context.Context, challengeId string, username string) (*model.FaceLivenessChallenge, error)
+}
+
+type livenessService struct {
+	mongo   *mongo.Client
+	actions []string
+}
+
+func NewLivenessService(mongo *mongo.Client) (LivenessService, error) {
+	s := &livenessService{mongo: mongo}
+	for _, action := range strings.Split(config.LIVENESS_ACTIONS, ",") {
+		action = strings.TrimSpace(action)
+		if action == "" {
+			continue
+		}
+		if action == livenessBlink {
+			return nil, errors.New("liveness action blink needs the 68 point landmark model, which isn't loaded")
+		}
+		if !isLivenessAction(action) {
+			return nil, fmt.Errorf("unknown liveness action %q, expected one of %v", action, livenessActions)
+		}
+		s.actions = append(s.actions, action)
+	}
+	if len(s.actions) == 0 {
+		return nil, errors.New("LIVENESS_ACTIONS is empty")
+	}
+	return s, nil
+}
+
+// EnsureIndexes lets Mongo drop challenges once they expired.
+func (s *livenessService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    map[string]any{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (s *livenessService) IssueChallenge(r *gin.Context, username string) (*helper.Response, *helper.Response) {
+	if username == "" {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: "Invalid Username",
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error generating liveness challenge: %v", err),
+		}
+	}
+	actions, err := s.pickActions()
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error generating liveness challenge: %v", err),
+		}
+	}
+
+	now := time.Now().In(config.JakartaLocation)
+	challenge := model.FaceLivenessChallenge{
+		Id:        hex.EncodeToString(id),
+		Username:  username,
+		Actions:   actions,
+		ExpiresAt: now.Add(config.LIVENESS_CHALLENGE_TTL),
+		CreatedAt: now,
+	}
+	if _, err := s.collection().InsertOne(r, challenge); err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error saving liveness challenge: %v", err),
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Liveness challenge created successfully",
+		Data: map[string]any{
+			"challenge_id": challenge.Id,
+			"actions":      challenge.Actions,
+			"expires_at":   challenge.ExpiresAt,
+			"min_frames":   config.LIVENESS_MIN_FRAMES,
+			"max_frames":   config.LIVENESS_MAX_FRAMES,
+		},
+	}, nil
+}
+
+// pickActions draws LIVENESS_ACTION_COUNT distinct actions in random order.
+func (s *livenessService) pickActions() ([]string, error) {
+	pool := append([]string{}, s.actions...)
+	count := min(max(config.LIVENESS_ACTION_COUNT, 1), len(pool))
+
+	actions := make([]string, 0, count)
+	for len(actions) < count {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(pool))))
+		if err != nil {
+			return nil, err
+		}
+		i := int(n.Int64())
+		actions = append(actions, pool[i])
+		pool = append(pool[:i], pool[i+1:]...)
+	}
+	return actions, nil
+}
+
+func (s *livenessService) Consume(ctx context.Context, challengeId string, username string) (*model.FaceLivenessChallenge, error) {
+	var challenge model.FaceLivenessChallenge
+	err := s.collection().FindOneAndUpdate(
+		ctx,
+		map[string]any{
+			"_id":        challengeId,
+			"username":   username,
+			"used":       false,
+			"expires_at": map[string]any{"$gt": time.Now()},
+		},
+		map[string]any{"$set": map[string]any{"used": true}},
+	).Decode(&challenge)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func (s *livenessService) collection() *mongo.Collection {
+	return s.mongo.Database(config.MONGO_DB).Collection(faceLivenessChallengeCollection)
+}
+
+func isLivenessAction(action string) bool {
+	for _, a := range livenessActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLiveness looks for the actions, in order, in the landmarks of the
+// frames. The first frame has to face the camera.
+func checkLiveness(actions []string, frames []landmarks) ([]string, string) {
+	performed := []string{}
+	if len(frames) == 0 || math.Abs(frames[0].yaw()) > frontalYaw {
+		return performed, "the first frame must face the camera"
+	}
+
+	next := 1
+	for _, action := range actions {
+		found := false
+		for ; next < len(frames) && !found; next++ {
+			found = performsAction(action, frames[next])
+		}
+		if !found {
+			return performed, fmt.Sprintf("%s was not performed", action)
+		}
+		performed = append(performed, action)
+	}
+	return performed, ""
+}
+
+// performsAction reports whether frame shows action.
+func performsAction(action string, frame landmarks) bool {
+	threshold := float64(config.LIVENESS_YAW_THRESHOLD)
+	switch action {
+	case LivenessTurnLeft:
+		return frame.yaw() >= threshold
+	case LivenessTurnRight:
+		return frame.yaw() <= -threshold
+	}
+	return false
+}
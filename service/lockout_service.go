@@ -0,0 +1,205 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const faceLockoutCollection = "face_lockout"
+
+// LockoutService locks a username or a device out of verification after
+// LOCKOUT_MAX_FAILURES failed matches within LOCKOUT_WINDOW, and an IP
+// after LOCKOUT_IP_MAX_FAILURES. Every new lockout of the same subject lasts
+// twice as long as the previous one.
+type LockoutService interface {
+	// Check returns how long the first locked key stays locked, zero when
+	// none is.
+	Check(ctx context.Context, keys []string) (time.Duration, error)
+	RecordFailure(ctx context.Context, keys []string)
+	RecordSuccess(ctx context.Context, keys []string)
+	Clear(r *gin.Context, keys []string) (*helper.Response, *helper.Response)
+}
+
+type lockoutService struct {
+	lockouts mongoCollection
+}
+
+func NewLockoutService(mongo *mongo.Client) LockoutService {
+	return &lockoutService{lockouts: mongo.Database(config.MONGO_DB).Collection(faceLockoutCollection)}
+}
+
+// LockoutKeys returns the subjects a verification counts against: the
+// username, the X-Device-ID when sent and the IP when LOCKOUT_IP_MAX_FAILURES
+// enables it. The device ID is chosen by the client, so it only adds a key:
+// a fresh one on every attempt still counts against the username. The IP is
+// off by default, users behind one proxy or office NAT share it.
+func LockoutKeys(r *gin.Context, username string) []string {
+	keys := []string{"user:" + username}
+	if config.LOCKOUT_IP_MAX_FAILURES > 0 {
+		keys = append(keys, "ip:"+r.ClientIP())
+	}
+	if deviceId := r.GetHeader("X-Device-ID"); deviceId != "" {
+		keys = append(keys, "device:"+deviceId)
+	}
+	return keys
+}
+
+func (s *lockoutService) Check(ctx context.Context, keys []string) (time.Duration, error) {
+	cursor, err := s.lockouts.Find(ctx, map[string]any{
+		"_id":          map[string]any{"$in": keys},
+		"locked_until": map[string]any{"$gt": time.Now()},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var lockouts []model.FaceLockout
+	if err := cursor.All(ctx, &lockouts); err != nil {
+		return 0, err
+	}
+
+	var retryAfter time.Duration
+	for _, lockout := range lockouts {
+		if remaining := time.Until(lockout.LockedUntil); remaining > retryAfter {
+			retryAfter = remaining
+		}
+	}
+	return retryAfter, nil
+}
+
+// RecordFailure counts a failure of every key in a single atomic update, so
+// concurrent attempts can't overwrite each other's count. The first attempt
+// to reach the maximum of the key locks it and resets its count.
+func (s *lockoutService) RecordFailure(ctx context.Context, keys []string) {
+	now := time.Now().In(config.JakartaLocation)
+	for _, key := range keys {
+		// Start a new window once the previous one has passed, a missing
+		// window_start sorts before any date
+		windowExpired := map[string]any{"$lt": []any{"$window_start", now.Add(-config.LOCKOUT_WINDOW)}}
+		var lockout model.FaceLockout
+		err := s.lockouts.FindOneAndUpdate(
+			ctx,
+			map[string]any{"_id": key},
+			[]any{map[string]any{"$set": map[string]any{
+				"failures": map[string]any{"$cond": []any{
+					windowExpired,
+					1,
+					map[string]any{"$add": []any{map[string]any{"$ifNull": []any{"$failures", 0}}, 1}},
+				}},
+				"window_start": map[string]any{"$cond": []any{windowExpired, now, "$window_start"}},
+				"updated_at":   now,
+			}}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&lockout)
+		if err != nil {
+			log.Printf("Error saving lockout state of %s: %v", key, err)
+			continue
+		}
+		maxFailures := lockoutMaxFailures(key)
+		if lockout.Failures < maxFailures {
+			continue
+		}
+
+		// Of concurrent attempts over the limit, only the first still finds
+		// the count over it
+		lockedUntil := now.Add(lockoutDuration(lockout.LockoutCount + 1))
+		result, err := s.lockouts.UpdateOne(
+			ctx,
+			map[string]any{"_id": key, "failures": map[string]any{"$gte": maxFailures}},
+			map[string]any{
+				"$set": map[string]any{
+					"failures":     0,
+					"window_start": now,
+					"locked_until": lockedUntil,
+					"updated_at":   now,
+				},
+				"$inc": map[string]any{"lockout_count": 1},
+			},
+		)
+		if err != nil {
+			log.Printf("Error locking out %s: %v", key, err)
+			continue
+		}
+		if result.MatchedCount == 0 {
+			continue
+		}
+		log.Printf("Locked out %s until %s after repeated failed verifications", key, lockedUntil)
+	}
+}
+
+// RecordSuccess forgets the failures of the verified username. Device and
+// IP keys are kept, a device trying many usernames stays suspicious.
+func (s *lockoutService) RecordSuccess(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "user:") {
+			continue
+		}
+		if _, err := s.lockouts.DeleteOne(ctx, map[string]any{"_id": key}); err != nil {
+			log.Printf("Error resetting lockout state of %s: %v", key, err)
+		}
+	}
+}
+
+func (s *lockoutService) Clear(r *gin.Context, keys []string) (*helper.Response, *helper.Response) {
+	result, err := s.lockouts.DeleteMany(r, map[string]any{"_id": map[string]any{"$in": keys}})
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error clearing lockout: %v", err),
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Lockout cleared successfully",
+		Data: map[string]any{
+			"keys":    keys,
+			"cleared": result.DeletedCount,
+		},
+	}, nil
+}
+
+// lockoutMaxFailures is the number of failures that locks key. An IP is
+// shared by every user behind it and gets its own, usually higher, limit.
+func lockoutMaxFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return config.LOCKOUT_IP_MAX_FAILURES
+	}
+	return config.LOCKOUT_MAX_FAILURES
+}
+
+// lockoutDuration doubles LOCKOUT_BASE_DURATION for every previous lockout,
+// up to LOCKOUT_MAX_DURATION.
+func lockoutDuration(lockoutCount int) time.Duration {
+	factor := math.Pow(2, float64(lockoutCount-1))
+	duration := time.Duration(float64(config.LOCKOUT_BASE_DURATION) * factor)
+	if duration <= 0 || duration > config.LOCKOUT_MAX_DURATION {
+		return config.LOCKOUT_MAX_DURATION
+	}
+	return duration
+}
+
+// lockedOutResponse is the 423 answer for a locked subject.
+func lockedOutResponse(r *gin.Context, retryAfter time.Duration) *helper.Response {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	r.Header("Retry-After", strconv.Itoa(seconds))
+	return &helper.Response{
+		Status:  423,
+		Message: "Too many failed verifications, please try again later",
+		Data: map[string]any{
+			"retry_after_seconds": seconds,
+		},
+	}
+}
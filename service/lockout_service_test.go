@@ -0,0 +1,231 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/model"
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func withLockoutConfig(t *testing.T, maxFailures int, ipMaxFailures int) {
+	requireTimeZone(t)
+	oldMax, oldIpMax := config.LOCKOUT_MAX_FAILURES, config.LOCKOUT_IP_MAX_FAILURES
+	oldWindow, oldBase, oldMaxDuration := config.LOCKOUT_WINDOW, config.LOCKOUT_BASE_DURATION, config.LOCKOUT_MAX_DURATION
+	t.Cleanup(func() {
+		config.LOCKOUT_MAX_FAILURES, config.LOCKOUT_IP_MAX_FAILURES = oldMax, oldIpMax
+		config.LOCKOUT_WINDOW, config.LOCKOUT_BASE_DURATION, config.LOCKOUT_MAX_DURATION = oldWindow, oldBase, oldMaxDuration
+	})
+
+	config.LOCKOUT_MAX_FAILURES = maxFailures
+	config.LOCKOUT_IP_MAX_FAILURES = ipMaxFailures
+	config.LOCKOUT_WINDOW = 15 * time.Minute
+	config.LOCKOUT_BASE_DURATION = 5 * time.Minute
+	config.LOCKOUT_MAX_DURATION = time.Hour
+}
+
+func lockoutState(t *testing.T, c *fakeCollection, key string) model.FaceLockout {
+	t.Helper()
+	var lockout model.FaceLockout
+	d := c.doc(key)
+	if d == nil {
+		return lockout
+	}
+	data, err := bson.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bson.Unmarshal(data, &lockout); err != nil {
+		t.Fatal(err)
+	}
+	return lockout
+}
+
+func TestRecordFailureLocksOutAfterMaxFailures(t *testing.T) {
+	withLockoutConfig(t, 3, 0)
+	ctx := context.Background()
+	c := newFakeCollection()
+	s := &lockoutService{lockouts: c}
+	keys := []string{"user:arman"}
+
+	for i := 1; i < 3; i++ {
+		s.RecordFailure(ctx, keys)
+		if retryAfter, err := s.Check(ctx, keys); err != nil || retryAfter != 0 {
+			t.Fatalf("locked after %d failures: %s, %v", i, retryAfter, err)
+		}
+	}
+
+	s.RecordFailure(ctx, keys)
+	retryAfter, err := s.Check(ctx, keys)
+	if err != nil || retryAfter <= 4*time.Minute || retryAfter > 5*time.Minute {
+		t.Fatalf("Check() = %s, %v, want about 5m", retryAfter, err)
+	}
+	if state := lockoutState(t, c, "user:arman"); state.Failures != 0 || state.LockoutCount != 1 {
+		t.Errorf("state after lockout = %+v, want failures reset and one lockout", state)
+	}
+}
+
+// TestRecordFailureConcurrent sends exactly LOCKOUT_MAX_FAILURES failures
+// at once. A read-modify-write count would lose some of them and never
+// lock; the atomic one locks exactly once.
+func TestRecordFailureConcurrent(t *testing.T) {
+	withLockoutConfig(t, 5, 0)
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		c := newFakeCollection()
+		s := &lockoutService{lockouts: c}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.RecordFailure(ctx, []string{"user:arman"})
+			}()
+		}
+		wg.Wait()
+
+		state := lockoutState(t, c, "user:arman")
+		if state.LockoutCount != 1 || state.Failures != 0 || !state.LockedUntil.After(time.Now()) {
+			t.Fatalf("round %d: state = %+v, want locked exactly once", round, state)
+		}
+	}
+}
+
+func TestRecordFailureStartsNewWindow(t *testing.T) {
+	withLockoutConfig(t, 3, 0)
+	ctx := context.Background()
+	c := newFakeCollection()
+	s := &lockoutService{lockouts: c}
+
+	c.InsertOne(ctx, model.FaceLockout{
+		Key:         "user:arman",
+		Failures:    2,
+		WindowStart: time.Now().Add(-time.Hour),
+	})
+	s.RecordFailure(ctx, []string{"user:arman"})
+
+	state := lockoutState(t, c, "user:arman")
+	if state.Failures != 1 || time.Since(state.WindowStart) > time.Minute {
+		t.Errorf("state = %+v, want a new window with one failure", state)
+	}
+	if !state.LockedUntil.IsZero() {
+		t.Errorf("locked until %s by failures of an old window", state.LockedUntil)
+	}
+}
+
+func TestRecordFailureDoublesRepeatedLockouts(t *testing.T) {
+	withLockoutConfig(t, 3, 0)
+	ctx := context.Background()
+	c := newFakeCollection()
+	s := &lockoutService{lockouts: c}
+
+	c.InsertOne(ctx, model.FaceLockout{
+		Key:          "user:arman",
+		Failures:     2,
+		WindowStart:  time.Now(),
+		LockoutCount: 1,
+	})
+	s.RecordFailure(ctx, []string{"user:arman"})
+
+	state := lockoutState(t, c, "user:arman")
+	if until := time.Until(state.LockedUntil); state.LockoutCount != 2 || until <= 9*time.Minute || until > 10*time.Minute {
+		t.Errorf("state = %+v, want the second lockout to last 10m", state)
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	withLockoutConfig(t, 3, 0)
+	tests := []struct {
+		lockoutCount int
+		want         time.Duration
+	}{
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{4, 40 * time.Minute},
+		{5, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := lockoutDuration(tt.lockoutCount); got != tt.want {
+			t.Errorf("lockoutDuration(%d) = %s, want %s", tt.lockoutCount, got, tt.want)
+		}
+	}
+}
+
+// TestRecordFailureIpLimit checks that the shared IP key has its own, higher
+// limit.
+func TestRecordFailureIpLimit(t *testing.T) {
+	withLockoutConfig(t, 3, 10)
+	ctx := context.Background()
+	c := newFakeCollection()
+	s := &lockoutService{lockouts: c}
+
+	for i := 0; i < 3; i++ {
+		s.RecordFailure(ctx, []string{"user:arman", "ip:10.0.0.1"})
+	}
+	if state := lockoutState(t, c, "user:arman"); state.LockoutCount != 1 {
+		t.Errorf("user state = %+v, want locked", state)
+	}
+	if state := lockoutState(t, c, "ip:10.0.0.1"); state.LockoutCount != 0 || state.Failures != 3 {
+		t.Errorf("ip state = %+v, want 3 failures and no lockout", state)
+	}
+}
+
+func TestRecordSuccessKeepsDeviceFailures(t *testing.T) {
+	withLockoutConfig(t, 3, 0)
+	ctx := context.Background()
+	c := newFakeCollection()
+	s := &lockoutService{lockouts: c}
+
+	keys := []string{"user:arman", "device:phone-1"}
+	s.RecordFailure(ctx, keys)
+	s.RecordSuccess(ctx, keys)
+
+	if c.doc("user:arman") != nil {
+		t.Error("failures of the verified user were kept")
+	}
+	if state := lockoutState(t, c, "device:phone-1"); state.Failures != 1 {
+		t.Errorf("device state = %+v, want its failure kept", state)
+	}
+}
+
+func TestLockoutKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name          string
+		ipMaxFailures int
+		deviceId      string
+		want          []string
+	}{
+		{"user only", 0, "", []string{"user:arman"}},
+		{"device", 0, "phone-1", []string{"user:arman", "device:phone-1"}},
+		{"ip enabled", 20, "phone-1", []string{"user:arman", "ip:192.0.2.1", "device:phone-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withLockoutConfig(t, 5, tt.ipMaxFailures)
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/api/face/validate/image", nil)
+			if tt.deviceId != "" {
+				c.Request.Header.Set("X-Device-ID", tt.deviceId)
+			}
+
+			got := LockoutKeys(c, "arman")
+			if len(got) != len(tt.want) {
+				t.Fatalf("LockoutKeys() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("LockoutKeys() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoCollection is the part of *mongo.Collection the stores use, so their
+// concurrency rules can be tested against an in-memory collection.
+type mongoCollection interface {
+	Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult
+	FindOneAndUpdate(ctx context.Context, filter any, update any, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error)
+	InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	Indexes() mongo.IndexView
+}
+
+// userCollection holds the enrolled users and their face keys.
+func userCollection(mongo *mongo.Client) mongoCollection {
+	return mongo.Database(config.MONGO_DB).Collection("user")
+}
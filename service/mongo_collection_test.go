@@ -0,0 +1,644 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeCollection is an in-memory mongoCollection implementing the filters,
+// updates and pipeline expressions the stores use. Every operation holds
+// the lock, so like Mongo a single write is atomic.
+type fakeCollection struct {
+	mu   sync.Mutex
+	docs []bson.M
+	// beforeUpdate runs once at the start of the next UpdateOne, to let a
+	// concurrent writer in between a read and the guarded write.
+	beforeUpdate func()
+}
+
+func newFakeCollection() *fakeCollection {
+	return &fakeCollection{}
+}
+
+// requireTimeZone loads config.JakartaLocation, which main sets up.
+func requireTimeZone(t *testing.T) {
+	t.Helper()
+	if err := config.InitTimeZone(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// doc returns a copy of the document with _id, nil when there is none.
+func (c *fakeCollection) doc(id any) bson.M {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range c.docs {
+		if fakeEqual(d["_id"], normalizeValue(id)) {
+			return copyDoc(d)
+		}
+	}
+	return nil
+}
+
+func (c *fakeCollection) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.docs)
+}
+
+func (c *fakeCollection) Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var limit int64
+	for _, o := range opts {
+		if o != nil && o.Limit != nil {
+			limit = *o.Limit
+		}
+	}
+	var found []any
+	for _, d := range c.docs {
+		if fakeMatches(d, normalizeDoc(filter)) {
+			found = append(found, copyDoc(d))
+		}
+		if limit > 0 && int64(len(found)) == limit {
+			break
+		}
+	}
+	return mongo.NewCursorFromDocuments(found, nil, nil)
+}
+
+func (c *fakeCollection) FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d := c.first(normalizeDoc(filter)); d != nil {
+		return mongo.NewSingleResultFromDocument(copyDoc(d), nil, nil)
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (c *fakeCollection) FindOneAndUpdate(ctx context.Context, filter any, update any, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	upsert, after := false, false
+	for _, o := range opts {
+		if o != nil && o.Upsert != nil {
+			upsert = *o.Upsert
+		}
+		if o != nil && o.ReturnDocument != nil {
+			after = *o.ReturnDocument == options.After
+		}
+	}
+
+	f := normalizeDoc(filter)
+	d := c.first(f)
+	if d == nil {
+		if !upsert {
+			return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+		}
+		d = c.upsert(f, update)
+		if !after {
+			return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+		}
+		return mongo.NewSingleResultFromDocument(copyDoc(d), nil, nil)
+	}
+
+	before := copyDoc(d)
+	applyUpdate(d, update, false)
+	if after {
+		return mongo.NewSingleResultFromDocument(copyDoc(d), nil, nil)
+	}
+	return mongo.NewSingleResultFromDocument(before, nil, nil)
+}
+
+func (c *fakeCollection) CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var count int64
+	for _, d := range c.docs {
+		if fakeMatches(d, normalizeDoc(filter)) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (c *fakeCollection) InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d := normalizeDoc(document)
+	if _, ok := d["_id"]; !ok {
+		d["_id"] = primitive.NewObjectID()
+	}
+	for _, existing := range c.docs {
+		if fakeEqual(existing["_id"], d["_id"]) {
+			return nil, mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "duplicate key"}}}
+		}
+	}
+	c.docs = append(c.docs, d)
+	return &mongo.InsertOneResult{InsertedID: d["_id"]}, nil
+}
+
+func (c *fakeCollection) UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if hook := c.takeBeforeUpdate(); hook != nil {
+		hook()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	upsert := false
+	for _, o := range opts {
+		if o != nil && o.Upsert != nil {
+			upsert = *o.Upsert
+		}
+	}
+
+	f := normalizeDoc(filter)
+	d := c.first(f)
+	if d == nil {
+		if !upsert {
+			return &mongo.UpdateResult{}, nil
+		}
+		d = c.upsert(f, update)
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: d["_id"]}, nil
+	}
+
+	before := copyDoc(d)
+	applyUpdate(d, update, false)
+	result := &mongo.UpdateResult{MatchedCount: 1}
+	if !reflect.DeepEqual(before, d) {
+		result.ModifiedCount = 1
+	}
+	return result, nil
+}
+
+func (c *fakeCollection) DeleteOne(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.delete(filter, 1), nil
+}
+
+func (c *fakeCollection) DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.delete(filter, -1), nil
+}
+
+// Indexes isn't simulated, EnsureIndexes isn't run against the fake.
+func (c *fakeCollection) Indexes() mongo.IndexView {
+	return mongo.IndexView{}
+}
+
+func (c *fakeCollection) takeBeforeUpdate() func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hook := c.beforeUpdate
+	c.beforeUpdate = nil
+	return hook
+}
+
+func (c *fakeCollection) first(filter bson.M) bson.M {
+	for _, d := range c.docs {
+		if fakeMatches(d, filter) {
+			return d
+		}
+	}
+	return nil
+}
+
+// upsert inserts the equality fields of filter with update applied.
+func (c *fakeCollection) upsert(filter bson.M, update any) bson.M {
+	d := bson.M{}
+	for key, value := range filter {
+		if !strings.HasPrefix(key, "$") && !isOperatorDoc(value) {
+			d[key] = value
+		}
+	}
+	applyUpdate(d, update, true)
+	if _, ok := d["_id"]; !ok {
+		d["_id"] = primitive.NewObjectID()
+	}
+	c.docs = append(c.docs, d)
+	return d
+}
+
+func (c *fakeCollection) delete(filter any, limit int) *mongo.DeleteResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := normalizeDoc(filter)
+	kept := c.docs[:0]
+	var deleted int64
+	for _, d := range c.docs {
+		if (limit < 0 || deleted < int64(limit)) && fakeMatches(d, f) {
+			deleted++
+			continue
+		}
+		kept = append(kept, d)
+	}
+	c.docs = kept
+	return &mongo.DeleteResult{DeletedCount: deleted}
+}
+
+// normalizeDoc turns a struct or map into the bson.M Mongo would store.
+func normalizeDoc(v any) bson.M {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var d bson.M
+	if err := bson.Unmarshal(data, &d); err != nil {
+		panic(err)
+	}
+	return toM(d)
+}
+
+// normalizeValue converts a single value the same way, e.g. time.Time to
+// primitive.DateTime and []any to primitive.A.
+func normalizeValue(v any) any {
+	return normalizeDoc(bson.M{"v": v})["v"]
+}
+
+func copyDoc(d bson.M) bson.M {
+	return normalizeDoc(d)
+}
+
+// toM converts nested primitive.D documents to bson.M.
+func toM(v any) bson.M {
+	switch d := v.(type) {
+	case bson.M:
+		for key, value := range d {
+			d[key] = toNested(value)
+		}
+		return d
+	case primitive.D:
+		m := bson.M{}
+		for _, e := range d {
+			m[e.Key] = toNested(e.Value)
+		}
+		return m
+	}
+	return nil
+}
+
+func toNested(v any) any {
+	switch value := v.(type) {
+	case bson.M, primitive.D:
+		return toM(value)
+	case primitive.A:
+		for i := range value {
+			value[i] = toNested(value[i])
+		}
+		return value
+	}
+	return v
+}
+
+func isOperatorDoc(v any) bool {
+	d, ok := v.(bson.M)
+	if !ok || len(d) == 0 {
+		return false
+	}
+	for key := range d {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the values at a dotted path, descending into arrays like
+// Mongo does for go_face_templates.image_url. Nothing is returned for a
+// missing field.
+func lookup(v any, path []string) []any {
+	if len(path) == 0 {
+		return []any{v}
+	}
+	switch value := v.(type) {
+	case bson.M:
+		field, ok := value[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookup(field, path[1:])
+	case primitive.A:
+		var found []any
+		for _, element := range value {
+			if _, ok := element.(bson.M); ok {
+				found = append(found, lookup(element, path)...)
+			}
+		}
+		return found
+	}
+	return nil
+}
+
+func fakeMatches(d bson.M, filter bson.M) bool {
+	for key, condition := range filter {
+		if key == "$or" {
+			matched := false
+			for _, sub := range condition.(primitive.A) {
+				if fakeMatches(d, sub.(bson.M)) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		if !matchField(lookup(d, strings.Split(key, ".")), condition) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchField(values []any, condition any) bool {
+	if !isOperatorDoc(condition) {
+		return matchEquals(values, condition)
+	}
+	for op, arg := range condition.(bson.M) {
+		var ok bool
+		switch op {
+		case "$in":
+			for _, candidate := range arg.(primitive.A) {
+				if matchEquals(values, candidate) {
+					ok = true
+					break
+				}
+			}
+		case "$nin":
+			ok = true
+			for _, candidate := range arg.(primitive.A) {
+				if matchEquals(values, candidate) {
+					ok = false
+					break
+				}
+			}
+		case "$ne":
+			ok = !matchEquals(values, arg)
+		case "$exists":
+			ok = (len(values) > 0) == arg.(bool)
+		case "$gt", "$gte", "$lt", "$lte":
+			for _, value := range values {
+				cmp, comparable := fakeCompare(value, arg)
+				if !comparable || value == nil {
+					continue
+				}
+				if (op == "$gt" && cmp > 0) || (op == "$gte" && cmp >= 0) || (op == "$lt" && cmp < 0) || (op == "$lte" && cmp <= 0) {
+					ok = true
+					break
+				}
+			}
+		default:
+			panic("fakeCollection doesn't support " + op)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchEquals matches a missing or null field to nil like Mongo.
+func matchEquals(values []any, want any) bool {
+	if want == nil && len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if fakeEqual(value, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func fakeEqual(a, b any) bool {
+	if cmp, ok := fakeCompare(a, b); ok && a != nil && b != nil {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// fakeCompare orders numbers, dates and strings. Null sorts before
+// everything, as in aggregation expressions.
+func fakeCompare(a, b any) (int, bool) {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0, true
+		case a == nil:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return compareOrdered(x, y), true
+		}
+	}
+	if x, ok := a.(primitive.DateTime); ok {
+		if y, ok := b.(primitive.DateTime); ok {
+			return compareOrdered(x, y), true
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered[T int64 | float64 | primitive.DateTime](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func fakeAdd(a, b any) any {
+	x, _ := toFloat(a)
+	y, _ := toFloat(b)
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	if aFloat || bFloat {
+		return x + y
+	}
+	return int64(x + y)
+}
+
+// applyUpdate applies an update document or pipeline to d.
+func applyUpdate(d bson.M, update any, inserting bool) {
+	if pipeline, ok := normalizeValue(update).(primitive.A); ok {
+		for _, stage := range pipeline {
+			for op, fields := range stage.(bson.M) {
+				if op != "$set" {
+					panic("fakeCollection doesn't support pipeline stage " + op)
+				}
+				// Expressions see the document before the stage
+				before := copyDoc(d)
+				for key, expr := range fields.(bson.M) {
+					d[key] = evalExpr(before, expr)
+				}
+			}
+		}
+		return
+	}
+
+	for op, fields := range normalizeDoc(update) {
+		for key, value := range fields.(bson.M) {
+			switch op {
+			case "$set":
+				d[key] = value
+			case "$setOnInsert":
+				if inserting {
+					d[key] = value
+				}
+			case "$inc":
+				d[key] = fakeAdd(d[key], value)
+			case "$unset":
+				delete(d, key)
+			case "$push":
+				array, _ := d[key].(primitive.A)
+				d[key] = append(array, value)
+			case "$pull":
+				array, _ := d[key].(primitive.A)
+				kept := primitive.A{}
+				for _, element := range array {
+					if doc, ok := element.(bson.M); ok && isDocCondition(value) && fakeMatches(doc, value.(bson.M)) {
+						continue
+					}
+					if fakeEqual(element, value) {
+						continue
+					}
+					kept = append(kept, element)
+				}
+				d[key] = kept
+			default:
+				panic("fakeCollection doesn't support " + op)
+			}
+		}
+	}
+}
+
+func isDocCondition(v any) bool {
+	_, ok := v.(bson.M)
+	return ok
+}
+
+// evalExpr evaluates the aggregation expressions RecordFailure uses.
+func evalExpr(d bson.M, expr any) any {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			values := lookup(d, strings.Split(e[1:], "."))
+			if len(values) == 0 {
+				return nil
+			}
+			return values[0]
+		}
+		return e
+	case bson.M:
+		if len(e) != 1 {
+			return e
+		}
+		for op, arg := range e {
+			args, _ := arg.(primitive.A)
+			switch op {
+			case "$cond":
+				if evalExpr(d, args[0]) == true {
+					return evalExpr(d, args[1])
+				}
+				return evalExpr(d, args[2])
+			case "$lt":
+				cmp, _ := fakeCompare(evalExpr(d, args[0]), evalExpr(d, args[1]))
+				return cmp < 0
+			case "$add":
+				var sum any = int64(0)
+				for _, a := range args {
+					sum = fakeAdd(sum, evalExpr(d, a))
+				}
+				return sum
+			case "$ifNull":
+				if value := evalExpr(d, args[0]); value != nil {
+					return value
+				}
+				return evalExpr(d, args[1])
+			}
+			if strings.HasPrefix(op, "$") {
+				panic("fakeCollection doesn't support expression " + op)
+			}
+		}
+	}
+	return expr
+}
+
+// TestFakeCollection pins down the Mongo behaviour the store tests rely
+// on.
+func TestFakeCollection(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeCollection()
+
+	if _, err := c.InsertOne(ctx, bson.M{"_id": "a", "n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.InsertOne(ctx, bson.M{"_id": "a"}); !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("duplicate insert error = %v", err)
+	}
+
+	// A missing field equals null and is less than any date
+	if n, _ := c.CountDocuments(ctx, map[string]any{"missing": map[string]any{"$in": []any{0, nil}}}); n != 1 {
+		t.Errorf("$in with nil matched %d documents", n)
+	}
+	now := time.Now()
+	var got struct {
+		Started bool `bson:"started"`
+	}
+	err := c.FindOneAndUpdate(ctx, map[string]any{"_id": "a"},
+		[]any{map[string]any{"$set": map[string]any{
+			"started": map[string]any{"$lt": []any{"$missing", now}},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&got)
+	if err != nil || !got.Started {
+		t.Errorf("$lt of a missing field = %v, %v", got.Started, err)
+	}
+
+	// Array fields match through dotted paths, $pull removes by condition
+	c.InsertOne(ctx, bson.M{"_id": "b", "items": []map[string]any{{"id": "x"}, {"id": "y"}}})
+	if n, _ := c.CountDocuments(ctx, map[string]any{"items.id": "y"}); n != 1 {
+		t.Errorf("dotted array path matched %d documents", n)
+	}
+	c.UpdateOne(ctx, map[string]any{"_id": "b"}, map[string]any{"$pull": map[string]any{"items": map[string]any{"id": "x"}}})
+	if items := c.doc("b")["items"].(primitive.A); len(items) != 1 {
+		t.Errorf("$pull left %v", items)
+	}
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const requestNonceCollection = "face_request_nonce"
+
+// NonceStore remembers the nonces of signed requests for long enough to
+// outlive SIGNATURE_MAX_SKEW, so a signed request is accepted only once.
+type NonceStore interface {
+	EnsureIndexes(ctx context.Context) error
+	// Use records nonce and reports whether it was unused.
+	Use(ctx context.Context, nonce string) (bool, error)
+}
+
+type requestNonce struct {
+	Nonce     string    `bson:"_id"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+type nonceStore struct {
+	mongo *mongo.Client
+}
+
+func NewNonceStore(mongo *mongo.Client) NonceStore {
+	return &nonceStore{mongo: mongo}
+}
+
+// EnsureIndexes lets Mongo expire nonces once their timestamp is stale on
+// either side of the allowed skew.
+func (s *nonceStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    map[string]any{"created_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32((2 * config.SIGNATURE_MAX_SKEW).Seconds())),
+	})
+	return err
+}
+
+func (s *nonceStore) Use(ctx context.Context, nonce string) (bool, error) {
+	_, err := s.collection().InsertOne(ctx, requestNonce{
+		Nonce:     nonce,
+		CreatedAt: time.Now().In(config.JakartaLocation),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *nonceStore) collection() *mongo.Collection {
+	return s.mongo.Database(config.MONGO_DB).Collection(requestNonceCollection)
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/model"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/Kagami/go-face"
+)
+
+var ErrRecognizerPoolClosed = errors.New("recognizer pool is closed")
+
+// RecognizerPool hands out preloaded face recognizers. go-face recognizers
+// are not safe for concurrent use, so each one is owned by a single caller
+// between Acquire and Release.
+type RecognizerPool interface {
+	Acquire(ctx context.Context) (*face.Recognizer, error)
+	Release(rec *face.Recognizer)
+	Size() int
+	// Params are the recognizer parameters every recognizer of the pool
+	// was created with.
+	Params() model.RecognizerParams
+	Close()
+}
+
+type recognizerPool struct {
+	recognizers chan *face.Recognizer
+	size        int
+	params      model.RecognizerParams
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewRecognizerPool loads size recognizers from modelDir up front so a
+// missing or broken model fails at startup instead of on every request.
+func NewRecognizerPool(modelDir string, size int, params model.RecognizerParams) (RecognizerPool, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &recognizerPool{
+		recognizers: make(chan *face.Recognizer, size),
+		size:        size,
+		params:      params,
+		closed:      make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		rec, err := face.NewRecognizerWithConfig(modelDir, params.Size, params.Padding, params.Jittering)
+		if err != nil {
+			pool.closeLoaded()
+			return nil, fmt.Errorf("can't init face recognizer from %s: %w", modelDir, err)
+		}
+		pool.recognizers <- rec
+	}
+
+	log.Printf("Loaded %d face recognizer(s) from %s with %+v", size, modelDir, params)
+	return pool, nil
+}
+
+// RecognizerPools hold a pool per operation, so enrollment can afford more
+// jittering than verification. They share one pool when configured alike.
+type RecognizerPools struct {
+	Enroll RecognizerPool
+	Verify RecognizerPool
+}
+
+// NewRecognizerPools loads the pools with the RECOGNIZER_ENROLL_* and
+// RECOGNIZER_VERIFY_* parameters.
+func NewRecognizerPools(modelDir string, size int) (RecognizerPools, error) {
+	var pools RecognizerPools
+	verifyParams := model.RecognizerParams{
+		Size:      config.RECOGNIZER_VERIFY_SIZE,
+		Padding:   config.RECOGNIZER_VERIFY_PADDING,
+		Jittering: config.RECOGNIZER_VERIFY_JITTERING,
+	}
+	enrollParams := model.RecognizerParams{
+		Size:      config.RECOGNIZER_ENROLL_SIZE,
+		Padding:   config.RECOGNIZER_ENROLL_PADDING,
+		Jittering: config.RECOGNIZER_ENROLL_JITTERING,
+	}
+
+	verify, err := NewRecognizerPool(modelDir, size, verifyParams)
+	if err != nil {
+		return pools, err
+	}
+	pools.Verify = verify
+	pools.Enroll = verify
+	if enrollParams != verifyParams {
+		enroll, err := NewRecognizerPool(modelDir, size, enrollParams)
+		if err != nil {
+			verify.Close()
+			return pools, err
+		}
+		pools.Enroll = enroll
+	}
+	return pools, nil
+}
+
+// Close closes both pools, closing a shared pool twice is harmless.
+func (p RecognizerPools) Close() {
+	p.Enroll.Close()
+	p.Verify.Close()
+}
+
+// Acquire blocks until a recognizer is free, the context is done or the
+// pool is closed.
+func (p *recognizerPool) Acquire(ctx context.Context) (*face.Recognizer, error) {
+	select {
+	case <-p.closed:
+		return nil, ErrRecognizerPoolClosed
+	default:
+	}
+
+	select {
+	case rec := <-p.recognizers:
+		return rec, nil
+	case <-p.closed:
+		return nil, ErrRecognizerPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *recognizerPool) Release(rec *face.Recognizer) {
+	if rec == nil {
+		return
+	}
+	p.recognizers <- rec
+}
+
+func (p *recognizerPool) Size() int {
+	return p.size
+}
+
+func (p *recognizerPool) Params() model.RecognizerParams {
+	return p.params
+}
+
+// Close stops handing out recognizers, waits for the in-flight ones to be
+// released and frees all of them.
+func (p *recognizerPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		for i := 0; i < p.size; i++ {
+			rec := <-p.recognizers
+			rec.Close()
+		}
+	})
+}
+
+func (p *recognizerPool) closeLoaded() {
+	for {
+		select {
+		case rec := <-p.recognizers:
+			rec.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/model"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"math"
+	"sort"
+)
+
+// Spoof policies of SPOOF_POLICY.
+const (
+	SpoofPolicyOff    = "off"
+	SpoofPolicyLog    = "log"
+	SpoofPolicyReject = "reject"
+)
+
+// spoofGridSize is the side of the grayscale grid the face is resampled to
+// for the frequency analysis.
+const spoofGridSize = 64
+
+// Weights of each heuristic in the overall spoof score.
+const (
+	moireWeight     = 0.35
+	specularWeight  = 0.2
+	colorWeight     = 0.2
+	faceRatioWeight = 0.25
+)
+
+// analyzeSpoof scores a single image for presentation attacks, without any
+// cooperation of the user:
+//   - moire: periodic peaks in the spectrum of the face, left by the pixel
+//     grid of a screen being filmed
+//   - specular: saturated highlights, glare on glossy prints and screens
+//   - color: low saturation of the skin, common on prints
+//   - face ratio: faces much smaller or larger than a selfie, as when a
+//     photo or phone is held in front of the camera
+//
+// These are heuristics: they catch crude attacks and need SPOOF_THRESHOLD
+// tuned on real traffic, start with SPOOF_POLICY=log.
+func analyzeSpoof(fileBytes []byte, faceRect image.Rectangle) (model.FaceSpoofScores, error) {
+	img, err := jpeg.Decode(bytes.NewReader(fileBytes))
+	if err != nil {
+		return model.FaceSpoofScores{}, err
+	}
+
+	bounds := img.Bounds()
+	region := faceRect.Intersect(bounds)
+	if region.Empty() {
+		region = bounds
+	}
+
+	scores := model.FaceSpoofScores{
+		Moire:     moireScore(img, region),
+		FaceRatio: faceRatioScore(region, bounds),
+	}
+	scores.Specular, scores.Color = specularAndColorScores(img, region)
+	scores.Overall = moireWeight*scores.Moire +
+		specularWeight*scores.Specular +
+		colorWeight*scores.Color +
+		faceRatioWeight*scores.FaceRatio
+	scores.Suspected = scores.Overall >= config.SPOOF_THRESHOLD
+	return scores, nil
+}
+
+// moireScore measures how peaky the mid and high frequencies of the face
+// are. A natural face spreads its energy evenly around each frequency ring,
+// moiré stands out as isolated peaks.
+func moireScore(img image.Image, region image.Rectangle) float32 {
+	const n = spoofGridSize
+
+	// Box-average a centered square of the face into an n x n grayscale
+	// grid, minus its mean. Cells all have the same size, uneven ones would
+	// add a pattern of their own.
+	cell := min(region.Dx(), region.Dy()) / n
+	if cell == 0 {
+		return 0
+	}
+	origin := region.Min.Add(image.Point{X: (region.Dx() - n*cell) / 2, Y: (region.Dy() - n*cell) / 2})
+	var grid [n][n]float64
+	var mean float64
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			corner := origin.Add(image.Point{X: x * cell, Y: y * cell})
+			grid[y][x] = meanLuma(img, image.Rectangle{Min: corner, Max: corner.Add(image.Point{X: cell, Y: cell})})
+			mean += grid[y][x]
+		}
+	}
+	mean /= n * n
+
+	// A Hann window keeps the edges of the square from showing up as
+	// frequencies along the axes
+	var window [n]float64
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/(n-1))
+	}
+
+	// Separable 2D DFT: rows first, then columns
+	var cosTable, sinTable [n][n]float64
+	for k := 0; k < n; k++ {
+		for j := 0; j < n; j++ {
+			angle := 2 * math.Pi * float64(k*j) / n
+			cosTable[k][j], sinTable[k][j] = math.Cos(angle), math.Sin(angle)
+		}
+	}
+	var rowRe, rowIm [n][n]float64
+	for y := 0; y < n; y++ {
+		for u := 0; u < n; u++ {
+			for x := 0; x < n; x++ {
+				v := (grid[y][x] - mean) * window[x] * window[y]
+				rowRe[y][u] += v * cosTable[u][x]
+				rowIm[y][u] -= v * sinTable[u][x]
+			}
+		}
+	}
+
+	// Group the power of the mid and high frequencies by radius
+	rings := map[int][]float64{}
+	for v := 0; v < n; v++ {
+		fv := float64(min(v, n-v))
+		for u := 0; u < n; u++ {
+			fu := float64(min(u, n-u))
+			radius := int(math.Round(math.Hypot(fu, fv)))
+			if radius <= n/8 || radius > n/2 {
+				continue
+			}
+
+			var re, im float64
+			for y := 0; y < n; y++ {
+				re += rowRe[y][u]*cosTable[v][y] + rowIm[y][u]*sinTable[v][y]
+				im += rowIm[y][u]*cosTable[v][y] - rowRe[y][u]*sinTable[v][y]
+			}
+			rings[radius] = append(rings[radius], re*re+im*im)
+		}
+	}
+
+	// Compare every frequency with the median of its ring
+	var peakiness float64
+	for _, ring := range rings {
+		sort.Float64s(ring)
+		median := ring[len(ring)/2]
+		if median > 0 {
+			peakiness = math.Max(peakiness, ring[len(ring)-1]/median)
+		}
+	}
+
+	// A genuine face peaks at a few tens times the median of a ring, the
+	// regular pattern of a screen at hundreds to thousands
+	if peakiness <= 0 {
+		return 0
+	}
+	return clampScore((math.Log10(peakiness) - math.Log10(50)) / (math.Log10(1000) - math.Log10(50)))
+}
+
+func meanLuma(img image.Image, cell image.Rectangle) float64 {
+	var sum float64
+	for y := cell.Min.Y; y < cell.Max.Y; y++ {
+		for x := cell.Min.X; x < cell.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+	return sum / float64(cell.Dx()*cell.Dy()) / 0xffff
+}
+
+// specularAndColorScores samples the face for saturated highlights and for
+// its mean color saturation.
+func specularAndColorScores(img image.Image, region image.Rectangle) (float32, float32) {
+	// Sample about 10000 pixels
+	step := max(1, int(math.Sqrt(float64(region.Dx()*region.Dy())/10000)))
+
+	var highlights, pixels int
+	var saturation float64
+	for y := region.Min.Y; y < region.Max.Y; y += step {
+		for x := region.Min.X; x < region.Max.X; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			lo := min(r, g, b)
+			hi := max(r, g, b)
+			if lo > 240*0x101 {
+				highlights++
+			}
+			if hi > 0 {
+				saturation += float64(hi-lo) / float64(hi)
+			}
+			pixels++
+		}
+	}
+	if pixels == 0 {
+		return 0, 0
+	}
+
+	// 5% of blown out skin is glare, skin saturation is usually over 0.25
+	specular := clampScore(float64(highlights) / float64(pixels) / 0.05)
+	color := clampScore((0.25 - saturation/float64(pixels)) / 0.2)
+	return specular, color
+}
+
+// faceRatioScore rises as the face covers less than 4% or more than 60% of
+// the frame.
+func faceRatioScore(region image.Rectangle, bounds image.Rectangle) float32 {
+	ratio := float64(region.Dx()*region.Dy()) / float64(bounds.Dx()*bounds.Dy())
+	switch {
+	case ratio < 0.04:
+		return clampScore((0.04 - ratio) / 0.04)
+	case ratio > 0.6:
+		return clampScore((ratio - 0.6) / 0.3)
+	}
+	return 0
+}
+
+func clampScore(score float64) float32 {
+	return float32(math.Min(1, math.Max(0, score)))
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"arkan-face-key/helper"
+	"arkan-face-key/model"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const faceThresholdPolicyCollection = "face_threshold_policy"
+
+const (
+	ThresholdSourceDefault = "default"
+	ThresholdSourceUser    = model.ThresholdPolicyScopeUser
+	ThresholdSourceRole    = model.ThresholdPolicyScopeRole
+	ThresholdSourceRequest = "request"
+)
+
+// AppliedThreshold tells the client which policy decided its threshold.
+type AppliedThreshold struct {
+	Source  string `json:"source"`
+	Subject string `json:"subject,omitempty"`
+	// Clamped is set when the policy value was outside
+	// FACE_THRESHOLD_MIN..FACE_THRESHOLD_MAX.
+	Clamped bool `json:"clamped"`
+	// RequestIgnored is set when the caller sent a threshold without
+	// being allowed to.
+	RequestIgnored bool `json:"request_ignored,omitempty"`
+}
+
+// ThresholdPolicy owns the match threshold. It starts from FACE_THRESHOLD,
+// is overridden per role and then per user in Mongo, and is always clamped
+// to FACE_THRESHOLD_MIN..FACE_THRESHOLD_MAX. A threshold sent by the client
+// is only honored for privileged callers.
+type ThresholdPolicy interface {
+	EnsureIndexes(ctx context.Context) error
+	// Resolve returns the threshold in the units of metric. user is nil
+	// when no user is known yet, e.g. for identification.
+	Resolve(ctx context.Context, user *model.User, metric DistanceMetric, legacy bool, options dto.FaceMatchOptions) (float32, AppliedThreshold, error)
+	List(r *gin.Context) (*helper.Response, *helper.Response)
+	Set(r *gin.Context, scope string, subject string, threshold float32) (*helper.Response, *helper.Response)
+	Delete(r *gin.Context, scope string, subject string) (*helper.Response, *helper.Response)
+}
+
+type thresholdPolicy struct {
+	mongo *mongo.Client
+}
+
+func NewThresholdPolicy(mongo *mongo.Client) ThresholdPolicy {
+	return &thresholdPolicy{mongo: mongo}
+}
+
+func (p *thresholdPolicy) EnsureIndexes(ctx context.Context) error {
+	_, err := p.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    map[string]any{"scope": 1, "subject": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (p *thresholdPolicy) Resolve(ctx context.Context, user *model.User, metric DistanceMetric, legacy bool, options dto.FaceMatchOptions) (float32, AppliedThreshold, error) {
+	// Policy values are Euclidean, except in compat mode where the legacy
+	// thresholds were compared to the metric as they are
+	convert := metric.FromEuclidean
+	if legacy {
+		convert = func(d float32) float32 { return d }
+	}
+
+	applied := AppliedThreshold{Source: ThresholdSourceDefault}
+	threshold := convert(config.FACE_THRESHOLD)
+
+	switch {
+	case options.Threshold > 0 && options.Privileged:
+		// The client threshold is already in the units of the metric
+		applied.Source = ThresholdSourceRequest
+		threshold = options.Threshold
+	case user != nil:
+		if options.Threshold > 0 {
+			applied.RequestIgnored = true
+		}
+		policy, err := p.findOverride(ctx, *user)
+		if err != nil {
+			return 0, applied, err
+		}
+		if policy != nil {
+			applied.Source = policy.Scope
+			applied.Subject = policy.Subject
+			threshold = convert(policy.Threshold)
+		}
+	default:
+		applied.RequestIgnored = options.Threshold > 0
+	}
+
+	lower, upper := convert(config.FACE_THRESHOLD_MIN), convert(config.FACE_THRESHOLD_MAX)
+	if threshold < lower {
+		threshold, applied.Clamped = lower, true
+	}
+	if threshold > upper {
+		threshold, applied.Clamped = upper, true
+	}
+	return threshold, applied, nil
+}
+
+// findOverride returns the user policy, else the role policy of the user,
+// nil when there is none.
+func (p *thresholdPolicy) findOverride(ctx context.Context, user model.User) (*model.FaceThresholdPolicy, error) {
+	subjects := []map[string]any{
+		{"scope": model.ThresholdPolicyScopeUser, "subject": user.Username},
+	}
+	if user.Role != "" {
+		subjects = append(subjects, map[string]any{"scope": model.ThresholdPolicyScopeRole, "subject": user.Role})
+	}
+
+	for _, filter := range subjects {
+		var policy model.FaceThresholdPolicy
+		err := p.collection().FindOne(ctx, filter).Decode(&policy)
+		if err == nil {
+			return &policy, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (p *thresholdPolicy) List(r *gin.Context) (*helper.Response, *helper.Response) {
+	cursor, err := p.collection().Find(r, map[string]any{}, options.Find().SetSort(map[string]any{"scope": 1, "subject": 1}))
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error listing threshold policies: %v", err),
+		}
+	}
+
+	policies := []model.FaceThresholdPolicy{}
+	if err := cursor.All(r, &policies); err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error decoding threshold policies: %v", err),
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Threshold policies retrieved successfully",
+		Data: map[string]any{
+			"default":  config.FACE_THRESHOLD,
+			"min":      config.FACE_THRESHOLD_MIN,
+			"max":      config.FACE_THRESHOLD_MAX,
+			"policies": policies,
+		},
+	}, nil
+}
+
+func (p *thresholdPolicy) Set(r *gin.Context, scope string, subject string, threshold float32) (*helper.Response, *helper.Response) {
+	if errRes := validatePolicyScope(scope); errRes != nil {
+		return nil, errRes
+	}
+	if threshold < config.FACE_THRESHOLD_MIN || threshold > config.FACE_THRESHOLD_MAX {
+		return nil, &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Threshold must be between %g and %g", config.FACE_THRESHOLD_MIN, config.FACE_THRESHOLD_MAX),
+		}
+	}
+
+	policy := model.FaceThresholdPolicy{
+		Scope:     scope,
+		Subject:   subject,
+		Threshold: threshold,
+		UpdatedAt: time.Now().In(config.JakartaLocation),
+	}
+	_, err := p.collection().UpdateOne(
+		r,
+		map[string]any{"scope": scope, "subject": subject},
+		map[string]any{"$set": policy},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error saving threshold policy: %v", err),
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Threshold policy saved successfully",
+		Data:    policy,
+	}, nil
+}
+
+func (p *thresholdPolicy) Delete(r *gin.Context, scope string, subject string) (*helper.Response, *helper.Response) {
+	if errRes := validatePolicyScope(scope); errRes != nil {
+		return nil, errRes
+	}
+
+	result, err := p.collection().DeleteOne(r, map[string]any{"scope": scope, "subject": subject})
+	if err != nil {
+		return nil, &helper.Response{
+			Status:  500,
+			Message: fmt.Sprintf("Error deleting threshold policy: %v", err),
+		}
+	}
+	if result.DeletedCount == 0 {
+		return nil, &helper.Response{
+			Status:  404,
+			Message: "Threshold policy not found",
+		}
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Threshold policy deleted successfully",
+	}, nil
+}
+
+func (p *thresholdPolicy) collection() *mongo.Collection {
+	return p.mongo.Database(config.MONGO_DB).Collection(faceThresholdPolicyCollection)
+}
+
+func validatePolicyScope(scope string) *helper.Response {
+	if scope != model.ThresholdPolicyScopeUser && scope != model.ThresholdPolicyScopeRole {
+		return &helper.Response{
+			Status:  400,
+			Message: fmt.Sprintf("Scope must be %q or %q", model.ThresholdPolicyScopeUser, model.ThresholdPolicyScopeRole),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/dto"
+	"context"
+	"testing"
+)
+
+// TestResolveThreshold covers the requests that know no user yet, which
+// never read a policy override from Mongo.
+func TestResolveThreshold(t *testing.T) {
+	defaultThreshold, lower, upper := config.FACE_THRESHOLD, config.FACE_THRESHOLD_MIN, config.FACE_THRESHOLD_MAX
+	t.Cleanup(func() {
+		config.FACE_THRESHOLD, config.FACE_THRESHOLD_MIN, config.FACE_THRESHOLD_MAX = defaultThreshold, lower, upper
+	})
+
+	tests := []struct {
+		name         string
+		threshold    float32
+		lower, upper float32
+		metric       string
+		legacy       bool
+		options      dto.FaceMatchOptions
+		want         float32
+		wantSource   string
+		wantClamped  bool
+		wantIgnored  bool
+	}{
+		{
+			name:      "default in euclidean",
+			threshold: 0.5, lower: 0.3, upper: 0.6,
+			metric: MetricEuclidean,
+			want:   0.5, wantSource: ThresholdSourceDefault,
+		},
+		{
+			name:      "default converted to squared euclidean",
+			threshold: 0.5, lower: 0.3, upper: 0.6,
+			metric: MetricSquaredEuclidean,
+			want:   0.25, wantSource: ThresholdSourceDefault,
+		},
+		{
+			name:      "default converted to cosine",
+			threshold: 0.6, lower: 0.3, upper: 0.6,
+			metric: MetricCosine,
+			want:   0.18, wantSource: ThresholdSourceDefault,
+		},
+		{
+			name:      "legacy compares the values as they are",
+			threshold: 0.6, lower: 0.3, upper: 0.6,
+			metric: MetricHalfSquaredEuclidean, legacy: true,
+			want: 0.6, wantSource: ThresholdSourceDefault,
+		},
+		{
+			name:      "default clamped to the minimum",
+			threshold: 0.2, lower: 0.3, upper: 0.6,
+			metric: MetricEuclidean,
+			want:   0.3, wantSource: ThresholdSourceDefault, wantClamped: true,
+		},
+		{
+			name:      "privileged request in the units of the metric",
+			threshold: 0.6, lower: 0.3, upper: 0.6,
+			metric:  MetricSquaredEuclidean,
+			options: dto.FaceMatchOptions{Threshold: 0.2, Privileged: true},
+			want:    0.2, wantSource: ThresholdSourceRequest,
+		},
+		{
+			name:      "privileged request clamped to the maximum",
+			threshold: 0.6, lower: 0.3, upper: 0.6,
+			metric:  MetricSquaredEuclidean,
+			options: dto.FaceMatchOptions{Threshold: 0.5, Privileged: true},
+			want:    0.36, wantSource: ThresholdSourceRequest, wantClamped: true,
+		},
+		{
+			name:      "unprivileged request ignored",
+			threshold: 0.5, lower: 0.3, upper: 0.6,
+			metric:  MetricEuclidean,
+			options: dto.FaceMatchOptions{Threshold: 0.9},
+			want:    0.5, wantSource: ThresholdSourceDefault, wantIgnored: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.FACE_THRESHOLD, config.FACE_THRESHOLD_MIN, config.FACE_THRESHOLD_MAX = tt.threshold, tt.lower, tt.upper
+			metric, err := GetDistanceMetric(tt.metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, applied, err := (&thresholdPolicy{}).Resolve(context.Background(), nil, metric, tt.legacy, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !approxEqual(got, tt.want) {
+				t.Errorf("threshold = %v, want %v", got, tt.want)
+			}
+			if applied.Source != tt.wantSource || applied.Clamped != tt.wantClamped || applied.RequestIgnored != tt.wantIgnored {
+				t.Errorf("applied = %+v, want source %s, clamped %v, request ignored %v", applied, tt.wantSource, tt.wantClamped, tt.wantIgnored)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"arkan-face-key/helper"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Verification token signing algorithms, as named in the JWT header.
+const (
+	TokenAlgEdDSA = "EdDSA"
+	TokenAlgHS256 = "HS256"
+)
+
+var (
+	ErrInvalidVerificationToken   = errors.New("invalid verification token")
+	ErrVerificationTokensDisabled = errors.New("verification tokens are disabled, no signing key is configured")
+)
+
+// VerificationClaims are the claims of a verification token.
+type VerificationClaims struct {
+	Issuer    string  `json:"iss"`
+	Subject   string  `json:"sub"`
+	UserId    int     `json:"uid"`
+	Method    string  `json:"method"`
+	Distance  float32 `json:"distance"`
+	Threshold float32 `json:"threshold"`
+	Metric    string  `json:"metric"`
+	Client    string  `json:"client,omitempty"`
+	IssuedAt  int64   `json:"iat"`
+	ExpiresAt int64   `json:"exp"`
+	Id        string  `json:"jti"`
+}
+
+// VerificationTokenService issues short-lived JWTs proving a user passed a
+// face verification, so downstream services don't have to trust the app.
+// EdDSA tokens can be checked offline against the published JWKS, HS256
+// tokens only by services sharing the secret or through Introspect. Without
+// a configured key no tokens are issued, like request signing without
+// SIGNING_KEY_ENCRYPTION_KEY.
+type VerificationTokenService interface {
+	Issue(r *gin.Context, claims VerificationClaims) (string, time.Time, error)
+	Verify(token string) (VerificationClaims, error)
+	Introspect(r *gin.Context, token string) (*helper.Response, *helper.Response)
+	JWKS(r *gin.Context) (*helper.Response, *helper.Response)
+}
+
+// verificationTokenService with an empty alg is disabled.
+type verificationTokenService struct {
+	alg        string
+	keyId      string
+	privateKey ed25519.PrivateKey
+	secret     []byte
+}
+
+// NewVerificationTokenService loads the signing key of
+// VERIFICATION_TOKEN_ALG, and disables the tokens when there is none. An
+// EdDSA key is only generated without VERIFICATION_TOKEN_PRIVATE_KEY_FILE
+// when VERIFICATION_TOKEN_EPHEMERAL_KEY allows it, for development: its
+// tokens fail on other instances and after a restart.
+func NewVerificationTokenService() (VerificationTokenService, error) {
+	s := &verificationTokenService{alg: config.VERIFICATION_TOKEN_ALG}
+
+	switch s.alg {
+	case TokenAlgHS256:
+		if config.VERIFICATION_TOKEN_SECRET == "" {
+			log.Printf("VERIFICATION_TOKEN_SECRET is not set, verification tokens are disabled")
+			return &verificationTokenService{}, nil
+		}
+		s.secret = []byte(config.VERIFICATION_TOKEN_SECRET)
+		sum := sha256.Sum256(s.secret)
+		s.keyId = hex.EncodeToString(sum[:4])
+	case TokenAlgEdDSA:
+		if config.VERIFICATION_TOKEN_PRIVATE_KEY_FILE == "" && !config.VERIFICATION_TOKEN_EPHEMERAL_KEY {
+			log.Printf("VERIFICATION_TOKEN_PRIVATE_KEY_FILE is not set, verification tokens are disabled")
+			return &verificationTokenService{}, nil
+		}
+		privateKey, err := loadEd25519Key(config.VERIFICATION_TOKEN_PRIVATE_KEY_FILE)
+		if err != nil {
+			return nil, err
+		}
+		s.privateKey = privateKey
+		sum := sha256.Sum256(privateKey.Public().(ed25519.PublicKey))
+		s.keyId = hex.EncodeToString(sum[:8])
+	default:
+		return nil, fmt.Errorf("unknown VERIFICATION_TOKEN_ALG %q, expected %s or %s", s.alg, TokenAlgEdDSA, TokenAlgHS256)
+	}
+	return s, nil
+}
+
+// loadEd25519Key reads a PKCS#8 PEM private key, e.g. from
+// `openssl genpkey -algorithm ed25519`, or generates a temporary one
+// without path.
+func loadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		log.Printf("VERIFICATION_TOKEN_PRIVATE_KEY_FILE is not set, using a temporary key")
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	return privateKey, nil
+}
+
+// Issue fills in the registered claims and signs the token.
+func (s *verificationTokenService) Issue(r *gin.Context, claims VerificationClaims) (string, time.Time, error) {
+	if s.alg == "" {
+		return "", time.Time{}, ErrVerificationTokensDisabled
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(config.VERIFICATION_TOKEN_TTL)
+	claims.Issuer = config.VERIFICATION_TOKEN_ISSUER
+	claims.Client = r.GetString("client_name")
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = expiresAt.Unix()
+	claims.Id = hex.EncodeToString(jti)
+
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.keyId})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := base64.RawURLEncoding.EncodeToString(s.sign([]byte(signingInput)))
+	return signingInput + "." + signature, expiresAt.In(config.JakartaLocation), nil
+}
+
+func (s *verificationTokenService) sign(signingInput []byte) []byte {
+	if s.alg == TokenAlgHS256 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(signingInput)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(s.privateKey, signingInput)
+}
+
+func (s *verificationTokenService) Verify(token string) (VerificationClaims, error) {
+	var claims VerificationClaims
+	if s.alg == "" {
+		return claims, ErrVerificationTokensDisabled
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidVerificationToken
+	}
+
+	// Only accept our own algorithm and key
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJson, &header) != nil {
+		return claims, ErrInvalidVerificationToken
+	}
+	if header.Alg != s.alg || header.Kid != s.keyId {
+		return claims, ErrInvalidVerificationToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidVerificationToken
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	if s.alg == TokenAlgHS256 {
+		if !hmac.Equal(signature, s.sign(signingInput)) {
+			return claims, ErrInvalidVerificationToken
+		}
+	} else if !ed25519.Verify(s.privateKey.Public().(ed25519.PublicKey), signingInput, signature) {
+		return claims, ErrInvalidVerificationToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, ErrInvalidVerificationToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("verification token expired")
+	}
+	return claims, nil
+}
+
+// Introspect reports whether token is valid, answering 200 either way as
+// token introspection usually does.
+func (s *verificationTokenService) Introspect(r *gin.Context, token string) (*helper.Response, *helper.Response) {
+	claims, err := s.Verify(token)
+	if err != nil {
+		return &helper.Response{
+			Status:  200,
+			Message: err.Error(),
+			Data: map[string]any{
+				"active": false,
+			},
+		}, nil
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Verification token is valid",
+		Data: map[string]any{
+			"active": true,
+			"claims": claims,
+		},
+	}, nil
+}
+
+// JWKS publishes the public key. HS256 keys are secret, so the set is
+// empty then.
+func (s *verificationTokenService) JWKS(r *gin.Context) (*helper.Response, *helper.Response) {
+	keys := []map[string]string{}
+	if s.alg == TokenAlgEdDSA {
+		keys = append(keys, map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": TokenAlgEdDSA,
+			"use": "sig",
+			"kid": s.keyId,
+			"x":   base64.RawURLEncoding.EncodeToString(s.privateKey.Public().(ed25519.PublicKey)),
+		})
+	}
+
+	return &helper.Response{
+		Status:  200,
+		Message: "Verification token keys retrieved successfully",
+		Data: map[string]any{
+			"keys": keys,
+		},
+	}, nil
+}
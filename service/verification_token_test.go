@@ -0,0 +1,248 @@
+package service
+
+import (
+	"arkan-face-key/config"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rfc8037Key is the Ed25519 key of RFC 8037 appendix A.
+func rfc8037Key(t *testing.T) ed25519.PrivateKey {
+	seed, err := base64.RawURLEncoding.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// withTokenConfig sets the verification token config for one test.
+func withTokenConfig(t *testing.T, alg, secret, keyFile string, ephemeral bool) {
+	if err := config.InitTimeZone(); err != nil {
+		t.Fatal(err)
+	}
+	oldAlg, oldSecret, oldKeyFile, oldEphemeral := config.VERIFICATION_TOKEN_ALG, config.VERIFICATION_TOKEN_SECRET, config.VERIFICATION_TOKEN_PRIVATE_KEY_FILE, config.VERIFICATION_TOKEN_EPHEMERAL_KEY
+	oldIssuer, oldTTL := config.VERIFICATION_TOKEN_ISSUER, config.VERIFICATION_TOKEN_TTL
+	t.Cleanup(func() {
+		config.VERIFICATION_TOKEN_ALG, config.VERIFICATION_TOKEN_SECRET, config.VERIFICATION_TOKEN_PRIVATE_KEY_FILE, config.VERIFICATION_TOKEN_EPHEMERAL_KEY = oldAlg, oldSecret, oldKeyFile, oldEphemeral
+		config.VERIFICATION_TOKEN_ISSUER, config.VERIFICATION_TOKEN_TTL = oldIssuer, oldTTL
+	})
+
+	config.VERIFICATION_TOKEN_ALG = alg
+	config.VERIFICATION_TOKEN_SECRET = secret
+	config.VERIFICATION_TOKEN_PRIVATE_KEY_FILE = keyFile
+	config.VERIFICATION_TOKEN_EPHEMERAL_KEY = ephemeral
+	config.VERIFICATION_TOKEN_ISSUER = "arkan-face-key"
+	config.VERIFICATION_TOKEN_TTL = 2 * time.Minute
+}
+
+func writeKeyFile(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTokenContext(clientName string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set("client_name", clientName)
+	return c
+}
+
+// TestTokenSignatureKnownAnswers checks the signatures against the
+// examples of RFC 7515 A.1 (HS256) and RFC 8037 A.4 (EdDSA).
+func TestTokenSignatureKnownAnswers(t *testing.T) {
+	hmacKey, err := base64.RawURLEncoding.DecodeString("AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		service      *verificationTokenService
+		signingInput string
+		want         string
+	}{
+		{
+			name:         "HS256",
+			service:      &verificationTokenService{alg: TokenAlgHS256, secret: hmacKey},
+			signingInput: "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9.eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ",
+			want:         "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+		},
+		{
+			name:         "EdDSA",
+			service:      &verificationTokenService{alg: TokenAlgEdDSA, privateKey: rfc8037Key(t)},
+			signingInput: "eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc",
+			want:         "hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := base64.RawURLEncoding.EncodeToString(tt.service.sign([]byte(tt.signingInput)))
+			if got != tt.want {
+				t.Errorf("signature = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewVerificationTokenService(t *testing.T) {
+	edKeyFile := writeKeyFile(t, rfc8037Key(t))
+
+	tests := []struct {
+		name         string
+		alg          string
+		secret       string
+		keyFile      string
+		ephemeral    bool
+		wantErr      string
+		wantDisabled bool
+	}{
+		{name: "HS256", alg: TokenAlgHS256, secret: "secret"},
+		{name: "HS256 without secret", alg: TokenAlgHS256, wantDisabled: true},
+		{name: "EdDSA key file", alg: TokenAlgEdDSA, keyFile: edKeyFile},
+		{name: "EdDSA ephemeral key", alg: TokenAlgEdDSA, ephemeral: true},
+		{name: "EdDSA without key file", alg: TokenAlgEdDSA, wantDisabled: true},
+		{name: "EdDSA missing key file", alg: TokenAlgEdDSA, keyFile: filepath.Join(t.TempDir(), "missing.pem"), wantErr: "no such file"},
+		{name: "unknown alg", alg: "none", wantErr: "unknown VERIFICATION_TOKEN_ALG"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTokenConfig(t, tt.alg, tt.secret, tt.keyFile, tt.ephemeral)
+			s, err := NewVerificationTokenService()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || s == nil {
+				t.Fatalf("NewVerificationTokenService() = %v, %v", s, err)
+			}
+
+			_, _, err = s.Issue(newTokenContext("mobile"), VerificationClaims{Subject: "arman"})
+			if disabled := errors.Is(err, ErrVerificationTokensDisabled); disabled != tt.wantDisabled {
+				t.Errorf("Issue() error = %v, want disabled %v", err, tt.wantDisabled)
+			}
+		})
+	}
+}
+
+func TestVerificationTokenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		alg    string
+		secret string
+	}{
+		{"HS256", TokenAlgHS256, "secret"},
+		{"EdDSA", TokenAlgEdDSA, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTokenConfig(t, tt.alg, tt.secret, writeKeyFile(t, rfc8037Key(t)), false)
+			s, err := NewVerificationTokenService()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, expiresAt, err := s.Issue(newTokenContext("mobile"), VerificationClaims{
+				Subject:   "arman",
+				UserId:    7,
+				Method:    "face",
+				Distance:  0.31,
+				Threshold: 0.5,
+				Metric:    MetricEuclidean,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Until(expiresAt); d <= 0 || d > config.VERIFICATION_TOKEN_TTL {
+				t.Errorf("expires in %s, want within %s", d, config.VERIFICATION_TOKEN_TTL)
+			}
+
+			claims, err := s.Verify(token)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if claims.Subject != "arman" || claims.UserId != 7 || claims.Client != "mobile" || claims.Issuer != "arkan-face-key" || claims.Id == "" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsTokens(t *testing.T) {
+	withTokenConfig(t, TokenAlgEdDSA, "", writeKeyFile(t, rfc8037Key(t)), false)
+	s, err := NewVerificationTokenService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := s.Issue(newTokenContext("mobile"), VerificationClaims{Subject: "arman"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	// Same key id but HS256 keyed with the public key, the classic
+	// algorithm confusion attack
+	publicKey := s.(*verificationTokenService).privateKey.Public().(ed25519.PublicKey)
+	confused := &verificationTokenService{alg: TokenAlgHS256, keyId: s.(*verificationTokenService).keyId, secret: publicKey}
+	config.VERIFICATION_TOKEN_ALG = TokenAlgHS256
+	confusedToken, _, err := confused.Issue(newTokenContext("mobile"), VerificationClaims{Subject: "arman"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.VERIFICATION_TOKEN_TTL = -time.Second
+	expired, _, err := s.Issue(newTokenContext("mobile"), VerificationClaims{Subject: "arman"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey := &verificationTokenService{alg: TokenAlgEdDSA, keyId: s.(*verificationTokenService).keyId, privateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))}
+	config.VERIFICATION_TOKEN_TTL = time.Minute
+	otherKeyToken, _, err := otherKey.Issue(newTokenContext("mobile"), VerificationClaims{Subject: "arman"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamperedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`))
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"` + s.(*verificationTokenService).keyId + `"}`))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"two parts", parts[0] + "." + parts[1]},
+		{"tampered payload", parts[0] + "." + tamperedPayload + "." + parts[2]},
+		{"alg none", noneHeader + "." + parts[1] + "."},
+		{"HS256 with the public key", confusedToken},
+		{"other key", otherKeyToken},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!"},
+		{"expired", expired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Verify(tt.token); err == nil {
+				t.Error("Verify() accepted the token")
+			}
+		})
+	}
+}
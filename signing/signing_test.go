@@ -0,0 +1,176 @@
+package signing
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Known answers computed independently of this package.
+const (
+	testSecret     = "dGhpcyBpcyBhIHJhbmRvbSBzZWNyZXQ"
+	testSigningKey = "8bc62553ce126487a525ca6c4c120acbae9ab6b6cfe33fab0bf2f44225bee794"
+	testBody       = `{"username":"arman"}`
+	testBodyHash   = "ba8ad313a75dde3983f022836e9cf9bc8738ff274be55b130087f318c0d876d1"
+	testNonce      = "0123456789abcdef0123456789abcdef"
+	testSignature  = "e100f2bb716b5ad4d89f30a09ad393d942ce9f9e6c1b69451d24ebc886c11c16"
+)
+
+func TestDeriveKey(t *testing.T) {
+	tests := []struct {
+		secret string
+		want   string
+	}{
+		{"secret", "1374435fbf0c5a4f79a403adbca48285ea8c03127728725c969ed273ec9c2c4a"},
+		{testSecret, testSigningKey},
+	}
+	for _, tt := range tests {
+		if got := DeriveKey(tt.secret); got != tt.want {
+			t.Errorf("DeriveKey(%q) = %s, want %s", tt.secret, got, tt.want)
+		}
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{testBody, testBodyHash},
+	}
+	for _, tt := range tests {
+		if got := BodyHash([]byte(tt.body)); got != tt.want {
+			t.Errorf("BodyHash(%q) = %s, want %s", tt.body, got, tt.want)
+		}
+	}
+}
+
+// TestSignature uses test case 2 of RFC 4231 and a full request.
+func TestSignature(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		message string
+		want    string
+	}{
+		{"RFC 4231 case 2", "Jefe", "what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{
+			"request",
+			testSigningKey,
+			CanonicalString("post", "/api/face/validate/image?metric=cosine", "1700000000", testNonce, testBodyHash),
+			testSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Signature(tt.key, tt.message); got != tt.want {
+				t.Errorf("Signature = %s, want %s", got, tt.want)
+			}
+			if !Verify(tt.key, tt.message, tt.want) {
+				t.Error("Verify rejected the expected signature")
+			}
+		})
+	}
+}
+
+func TestCanonicalString(t *testing.T) {
+	got := CanonicalString("get", "/api/face/audit?page=2", "1700000000", testNonce, testBodyHash)
+	want := "GET\n/api/face/audit?page=2\n1700000000\n" + testNonce + "\n" + testBodyHash
+	if got != want {
+		t.Errorf("CanonicalString = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	message := CanonicalString("POST", "/api/face/save", "1700000000", testNonce, testBodyHash)
+	signature := Signature(testSigningKey, message)
+
+	tests := []struct {
+		name      string
+		key       string
+		message   string
+		signature string
+	}{
+		{"other key", DeriveKey("other"), message, signature},
+		{"other path", testSigningKey, strings.Replace(message, "/save", "/templates", 1), signature},
+		{"uppercase hex", testSigningKey, message, strings.ToUpper(signature)},
+		{"truncated", testSigningKey, message, signature[:32]},
+		{"empty", testSigningKey, message, ""},
+	}
+	for _, tt := range tests {
+		if Verify(tt.key, tt.message, tt.signature) {
+			t.Errorf("%s: Verify accepted the signature", tt.name)
+		}
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://face.example/api/face/validate/image?metric=cosine", strings.NewReader(testBody))
+	if err := SignRequest(req, "a1b2c3d4."+testSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := req.Header.Get(KeyIdHeader); got != "a1b2c3d4" {
+		t.Errorf("%s = %q, want the key id", KeyIdHeader, got)
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)).Abs() > time.Minute {
+		t.Errorf("%s = %q, want the current unix time", TimestampHeader, req.Header.Get(TimestampHeader))
+	}
+	if nonce := req.Header.Get(NonceHeader); len(nonce) != 32 {
+		t.Errorf("%s = %q, want 32 hex characters", NonceHeader, nonce)
+	}
+
+	// The server recomputes the signature from what it receives
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != testBody {
+		t.Errorf("body after signing = %q, want it unchanged", body)
+	}
+	message := CanonicalString(req.Method, req.URL.RequestURI(), req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader), BodyHash(body))
+	if !Verify(testSigningKey, message, req.Header.Get(SignatureHeader)) {
+		t.Error("signature doesn't verify with the derived key")
+	}
+}
+
+func TestSignRequestInvalidKey(t *testing.T) {
+	for _, apiKey := range []string{"", "no-dot", ".secret", "keyid."} {
+		req := httptest.NewRequest(http.MethodGet, "http://face.example/", nil)
+		if err := SignRequest(req, apiKey); err == nil {
+			t.Errorf("SignRequest with key %q succeeded, want an error", apiKey)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var signed *http.Request
+	transport := &Transport{
+		ApiKey: "a1b2c3d4." + testSecret,
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			signed = req
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://face.example/api/face/audit", nil)
+	req.RequestURI = ""
+	if _, err := (&http.Client{Transport: transport}).Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if signed == nil || signed.Header.Get(SignatureHeader) == "" {
+		t.Fatal("request was sent unsigned")
+	}
+	if req.Header.Get(SignatureHeader) != "" {
+		t.Error("Transport modified the caller's request")
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type cachedStorage struct {
+	Storage
+	cache *localStorage
+}
+
+// NewCachedStorage wraps backend with a read-through cache in a local
+// directory, keyed by file name. Face key file names are never reused, so
+// entries only have to be dropped when the file is overwritten or deleted.
+func NewCachedStorage(backend Storage, dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &cachedStorage{Storage: backend, cache: &localStorage{dir: dir}}, nil
+}
+
+func (s *cachedStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	s.evict(name)
+	return s.Storage.Put(ctx, name, r)
+}
+
+// Get serves the file from the cache, falling back to the backend and
+// keeping a copy of what it returned.
+func (s *cachedStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if file, err := s.cache.Get(ctx, name); err == nil {
+		return file, nil
+	}
+
+	file, err := s.Storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.Put(ctx, name, bytes.NewReader(data)); err != nil {
+		log.Printf("Error caching %s: %v", name, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *cachedStorage) Delete(ctx context.Context, name string) error {
+	s.evict(name)
+	return s.Storage.Delete(ctx, name)
+}
+
+func (s *cachedStorage) evict(name string) {
+	if err := validateName(name); err != nil {
+		return
+	}
+	os.Remove(filepath.Join(s.cache.dir, name))
+}
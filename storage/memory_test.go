@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	if err := s.Put(ctx, "arman_face_key.jpeg", strings.NewReader("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get(ctx, "arman_face_key.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "jpeg" {
+		t.Errorf("Get() = %q, %v", data, err)
+	}
+
+	names, err := s.List(ctx)
+	if err != nil || len(names) != 1 || names[0] != "arman_face_key.jpeg" {
+		t.Errorf("List() = %v, %v", names, err)
+	}
+
+	if err := s.Delete(ctx, "arman_face_key.jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "arman_face_key.jpeg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete error = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, "arman_face_key.jpeg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete() error = %v, want ErrNotFound", err)
+	}
+}
+
+// TestMemoryStorageValidatesNames applies the path rules of the other
+// backends, so tests against memory catch names production would refuse.
+func TestMemoryStorageValidatesNames(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	for _, name := range []string{"", ".", "..", "../etc/passwd", `..\secret`, "face_key/arman.jpeg"} {
+		if err := s.Put(ctx, name, strings.NewReader("jpeg")); err == nil {
+			t.Errorf("Put(%q) accepted the name", name)
+		}
+		if _, err := s.Get(ctx, name); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) error = %v, want an invalid name", name, err)
+		}
+		if err := s.Delete(ctx, name); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Delete(%q) error = %v, want an invalid name", name, err)
+		}
+	}
+}
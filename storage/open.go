@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"arkan-face-key/config"
+	"fmt"
+)
+
+// Open creates the storage backend selected by STORAGE_DRIVER, wrapped in
+// a local read-through cache when STORAGE_CACHE_DIR is set.
+func Open() (Storage, error) {
+	backend, err := openBackend()
+	if err != nil {
+		return nil, err
+	}
+	if config.STORAGE_CACHE_DIR == "" {
+		return backend, nil
+	}
+	return NewCachedStorage(backend, config.STORAGE_CACHE_DIR)
+}
+
+func openBackend() (Storage, error) {
+	switch config.STORAGE_DRIVER {
+	case "sftp":
+		client, err := config.OpenSFTPConnection()
+		if err != nil {
+			return nil, err
+		}
+		return NewSftpStorage(client, config.SFTP_ROOT+"face_key/"), nil
+	case "local":
+		return NewLocalStorage(config.STORAGE_LOCAL_DIR)
+	case "s3":
+		return NewS3Storage(S3Config{
+			Endpoint:  config.S3_ENDPOINT,
+			Region:    config.S3_REGION,
+			Bucket:    config.S3_BUCKET,
+			Prefix:    config.S3_PREFIX,
+			AccessKey: config.S3_ACCESS_KEY,
+			SecretKey: config.S3_SECRET_KEY,
+		})
+	case "memory":
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q, expected sftp, local, s3 or memory", config.STORAGE_DRIVER)
+	}
+}
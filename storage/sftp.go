@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+type sftpStorage struct {
+	client *sftp.Client
+	dir    string
+}
+
+// NewSftpStorage stores files in dir on an SFTP server.
+func NewSftpStorage(client *sftp.Client, dir string) Storage {
+	return &sftpStorage{client: client, dir: dir}
+}
+
+func (s *sftpStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	dstFile, err := s.client.Create(path.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	_, err = dstFile.ReadFrom(r)
+	return err
+}
+
+func (s *sftpStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	file, err := s.client.Open(path.Join(s.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (s *sftpStorage) Delete(ctx context.Context, name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	err := s.client.Remove(path.Join(s.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *sftpStorage) List(ctx context.Context) ([]string, error) {
+	files, err := s.client.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *sftpStorage) Driver() string {
+	return "sftp"
+}